@@ -0,0 +1,494 @@
+package staert
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPollInterval is the interval between two scans of a watched key or directory
+	defaultPollInterval = time.Second
+	// fileStoreTmpPrefix prefixes the temporary files written by a FileStore, they are not listed
+	fileStoreTmpPrefix = ".staert-tmp-"
+)
+
+// FileStore is a KvStore and a KvLocker keeping keys in a directory tree :
+// key prefixes are directories and values are files, a directory key (ending with /) is a directory.
+// Values are replaced atomically (written to a temporary file, then renamed), and LastIndex is a hash of the
+// modification time and value of the file.
+// Creating a key with AtomicPut (and so acquiring a lock) is atomic across processes sharing the directory,
+// other atomic operations are only atomic within a process.
+// Watch and WatchTree poll the files every PollInterval. Keys can not expire (it is not a KvTTLStore), except locks.
+type FileStore struct {
+	Root         string        // directory containing the keys
+	PollInterval time.Duration // interval between two scans of a watched key or directory (1s if not set)
+	mu           sync.Mutex
+	closed       chan struct{} // closed by Close, to stop watches (NewFileStore must be used to create it)
+	closeOnce    sync.Once
+}
+
+// NewFileStore creates a FileStore keeping keys in root, creating root if needed
+func NewFileStore(root string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{Root: root, closed: make(chan struct{})}, nil
+}
+
+func (s *FileStore) pollInterval() time.Duration {
+	if s.PollInterval > 0 {
+		return s.PollInterval
+	}
+	return defaultPollInterval
+}
+
+// path returns the path of key, and true if key is a directory key
+func (s *FileStore) path(key string) (string, bool, error) {
+	isDir := strings.HasSuffix(key, "/")
+	key = strings.Trim(key, "/")
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." || strings.HasPrefix(segment, fileStoreTmpPrefix) {
+			return "", false, fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), isDir, nil
+}
+
+// key returns the key of path, relative to the root
+func (s *FileStore) key(path string, isDir bool) (string, error) {
+	rel, err := filepath.Rel(s.Root, path)
+	if err != nil {
+		return "", err
+	}
+	key := filepath.ToSlash(rel)
+	if isDir {
+		key += "/"
+	}
+	return key, nil
+}
+
+// fileIndex returns the LastIndex of a file, changed by every write
+func fileIndex(info os.FileInfo, value []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(strconv.FormatInt(info.ModTime().UnixNano(), 10)))
+	hash.Write(value)
+	return hash.Sum64()
+}
+
+// read returns the pair of key, or ErrKeyNotFound
+func (s *FileStore) read(key string) (*KvPair, error) {
+	path, isDir, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() != isDir {
+		return nil, ErrKeyNotFound
+	}
+	var value []byte
+	if !isDir {
+		if value, err = ioutil.ReadFile(path); err != nil {
+			if os.IsNotExist(err) {
+				return nil, ErrKeyNotFound
+			}
+			return nil, err
+		}
+	}
+	return &KvPair{Key: key, Value: value, LastIndex: fileIndex(info, value)}, nil
+}
+
+// write writes value at key; if create, it fails with ErrKeyExists if the key exists
+func (s *FileStore) write(key string, value []byte, create bool) (*KvPair, error) {
+	path, isDir, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
+		if create {
+			if _, err := os.Stat(path); err == nil {
+				return nil, ErrKeyExists
+			}
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		return s.read(key)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), fileStoreTmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if create {
+		// a link fails if the key exists, even if it is created by another process
+		if err := os.Link(tmp.Name(), path); err != nil {
+			if os.IsExist(err) {
+				return nil, ErrKeyExists
+			}
+			return nil, err
+		}
+	} else if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return s.read(key)
+}
+
+// Put writes value at key
+func (s *FileStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.write(key, value, false)
+	return err
+}
+
+// Get returns the pair of key, or ErrKeyNotFound
+func (s *FileStore) Get(key string) (*KvPair, error) {
+	return s.read(key)
+}
+
+// Delete deletes key, or returns ErrKeyNotFound; deleting a directory key deletes its content
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.read(key); err != nil {
+		return err
+	}
+	path, _, _ := s.path(key)
+	return os.RemoveAll(path)
+}
+
+// List returns the pairs under directory, at any depth
+// It returns ErrKeyNotFound if there is neither a file nor a directory at directory.
+func (s *FileStore) List(directory string) ([]*KvPair, error) {
+	root, _, err := s.path(directory)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	var pairs []*KvPair
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// deleted while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path == root || strings.HasPrefix(info.Name(), fileStoreTmpPrefix) {
+			return nil
+		}
+		key, err := s.key(path, info.IsDir())
+		if err != nil {
+			return err
+		}
+		pair, err := s.read(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, pair)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
+
+// ListsRecursively returns true : List returns the pairs at any depth
+func (s *FileStore) ListsRecursively() bool {
+	return true
+}
+
+// DeleteTree deletes a range of keys under a given directory, and the directory
+func (s *FileStore) DeleteTree(directory string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path, _, err := s.path(directory)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// AtomicPut writes value at key if it was not modified since previous was read
+// If previous is nil, key must not exist.
+func (s *FileStore) AtomicPut(key string, value []byte, previous *KvPair) (*KvPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous == nil {
+		return s.write(key, value, true)
+	}
+	current, err := s.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if current.LastIndex != previous.LastIndex {
+		return nil, ErrKeyModified
+	}
+	return s.write(key, value, false)
+}
+
+// AtomicDelete deletes key if it was not modified since previous was read, or returns ErrKeyNotFound or ErrKeyModified
+func (s *FileStore) AtomicDelete(key string, previous *KvPair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.read(key)
+	if err != nil {
+		return err
+	}
+	if current.LastIndex != previous.LastIndex {
+		return ErrKeyModified
+	}
+	path, _, _ := s.path(key)
+	return os.RemoveAll(path)
+}
+
+// poll sends the value returned by snapshot every time it changes, until stopCh is closed or the store is closed
+// snapshot returns false if there is nothing to send.
+func (s *FileStore) poll(stopCh <-chan struct{}, snapshot func() (interface{}, bool)) <-chan interface{} {
+	watchCh := make(chan interface{})
+	go func() {
+		defer close(watchCh)
+		ticker := time.NewTicker(s.pollInterval())
+		defer ticker.Stop()
+		for {
+			if value, ok := snapshot(); ok {
+				select {
+				case watchCh <- value:
+				case <-stopCh:
+					return
+				case <-s.closed:
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-stopCh:
+				return
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+	return watchCh
+}
+
+// Watch sends the pair of key (if it exists), then every new value, until stopCh is closed
+// The key is polled every PollInterval.
+func (s *FileStore) Watch(key string, stopCh <-chan struct{}) (<-chan *KvPair, error) {
+	if _, _, err := s.path(key); err != nil {
+		return nil, err
+	}
+	var lastIndex uint64
+	values := s.poll(stopCh, func() (interface{}, bool) {
+		pair, err := s.read(key)
+		if err != nil || pair.LastIndex == lastIndex {
+			return nil, false
+		}
+		lastIndex = pair.LastIndex
+		return pair, true
+	})
+	watchCh := make(chan *KvPair)
+	go func() {
+		defer close(watchCh)
+		for value := range values {
+			select {
+			case watchCh <- value.(*KvPair):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// WatchTree sends the pairs under directory, then the new pairs after every change, until stopCh is closed
+// The directory is polled every PollInterval.
+func (s *FileStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*KvPair, error) {
+	if _, _, err := s.path(directory); err != nil {
+		return nil, err
+	}
+	var last []*KvPair
+	first := true
+	values := s.poll(stopCh, func() (interface{}, bool) {
+		pairs, err := s.List(directory)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, false
+		}
+		if !first && samePairs(pairs, last) {
+			return nil, false
+		}
+		first = false
+		last = pairs
+		return pairs, true
+	})
+	watchCh := make(chan []*KvPair)
+	go func() {
+		defer close(watchCh)
+		for value := range values {
+			select {
+			case watchCh <- value.([]*KvPair):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// NewLock creates a lock for key
+// If ttl is set, the lock file is renewed while it is held, and it can be taken over once it was not renewed for ttl,
+// for instance if its holder crashed.
+func (s *FileStore) NewLock(key string, ttl time.Duration) (KvLock, error) {
+	if _, _, err := s.path(key); err != nil {
+		return nil, err
+	}
+	return &fileLock{store: s, key: key, ttl: ttl}, nil
+}
+
+// Close the store : watches are stopped
+func (s *FileStore) Close() {
+	s.closeOnce.Do(func() {
+		if s.closed != nil {
+			close(s.closed)
+		}
+	})
+}
+
+// fileLock is the KvLock of a FileStore
+type fileLock struct {
+	store *FileStore
+	key   string
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	pair   *KvPair
+	stopCh chan struct{}
+}
+
+// Lock waits until the lock is acquired or stopChan is closed (then it returns a nil channel)
+// The returned channel is closed when the lock is lost.
+func (l *fileLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	ticker := time.NewTicker(l.store.pollInterval())
+	defer ticker.Stop()
+	for {
+		pair, err := l.store.AtomicPut(l.key, nil, nil)
+		if err == nil {
+			l.mu.Lock()
+			l.pair = pair
+			l.stopCh = make(chan struct{})
+			l.mu.Unlock()
+			lostCh := make(chan struct{})
+			go l.hold(lostCh, l.stopCh)
+			return lostCh, nil
+		}
+		if err != ErrKeyExists {
+			return nil, err
+		}
+		if l.ttl > 0 {
+			l.takeOverExpired()
+		}
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return nil, nil
+		}
+	}
+}
+
+// takeOverExpired deletes the lock file if it was not renewed for the TTL of the lock
+func (l *fileLock) takeOverExpired() {
+	path, _, _ := l.store.path(l.key)
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) < l.ttl {
+		return
+	}
+	if pair, err := l.store.Get(l.key); err == nil {
+		l.store.AtomicDelete(l.key, pair)
+	}
+}
+
+// hold renews the lock until it is unlocked, and closes lostCh if it is lost
+func (l *fileLock) hold(lostCh, stopCh chan struct{}) {
+	defer close(lostCh)
+	interval := l.store.pollInterval()
+	if l.ttl > 0 && l.ttl/3 < interval {
+		interval = l.ttl / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-l.store.closed:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.pair == nil {
+				// unlocked while renewing : a renewal would take the lock again
+				l.mu.Unlock()
+				return
+			}
+			if l.ttl > 0 {
+				if pair, err := l.store.AtomicPut(l.key, nil, l.pair); err == nil {
+					l.pair = pair
+				}
+			}
+			pair, err := l.store.Get(l.key)
+			held := err == nil && l.pair != nil && pair.LastIndex == l.pair.LastIndex
+			l.mu.Unlock()
+			if !held {
+				return
+			}
+		}
+	}
+}
+
+// Unlock releases the lock, and stops renewing it
+func (l *fileLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pair == nil {
+		return errors.New("lock not held")
+	}
+	close(l.stopCh)
+	err := l.store.AtomicDelete(l.key, l.pair)
+	l.pair = nil
+	if err == ErrKeyNotFound || err == ErrKeyModified {
+		// lost
+		return nil
+	}
+	return err
+}
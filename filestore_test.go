@@ -0,0 +1,224 @@
+package staert
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(t *testing.T) *FileStore {
+	s, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	s.PollInterval = 5 * time.Millisecond
+	return s
+}
+
+func TestFileStoreBasic(t *testing.T) {
+	s := newTestFileStore(t)
+	for _, key := range []string{"prefix/vfoo", "prefix/vmap/", "prefix/vmap/key", "prefixother"} {
+		if err := s.Put(key, []byte("value")); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	//check
+	value, err := ioutil.ReadFile(filepath.Join(s.Root, "prefix", "vmap", "key"))
+	if err != nil || string(value) != "value" {
+		t.Fatalf("Expected file prefix/vmap/key, got %q (%v)", value, err)
+	}
+	pair, err := s.Get("prefix/vfoo")
+	if err != nil || string(pair.Value) != "value" {
+		t.Fatalf("Expected prefix/vfoo, got %+v (%v)", pair, err)
+	}
+	if _, err := s.Get("prefix/vmap"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound for a directory, got %v", err)
+	}
+	pairs, err := s.List("prefix")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []string{"prefix/vfoo", "prefix/vmap/", "prefix/vmap/key"}
+	if !reflect.DeepEqual(pairKeys(pairs), expected) {
+		t.Fatalf("Got %v\nExpected: %v", pairKeys(pairs), expected)
+	}
+	if _, err := s.List("prefix/vbar"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := s.Put("prefix/../escape", []byte("value")); err == nil {
+		t.Fatal("Expected an error on a key outside of the root")
+	}
+
+	// deleting a directory key deletes its content
+	if err := s.Delete("prefix/vmap/"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.Get("prefix/vmap/key"); err != ErrKeyNotFound {
+		t.Fatal("Expected prefix/vmap/key to be deleted")
+	}
+	if err := s.DeleteTree("prefix"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.Get("prefix/vfoo"); err != ErrKeyNotFound {
+		t.Fatal("Expected prefix/vfoo to be deleted")
+	}
+	if _, err := s.Get("prefixother"); err != nil {
+		t.Fatal("Expected prefixother to exist")
+	}
+}
+
+func TestFileStoreAtomic(t *testing.T) {
+	s := newTestFileStore(t)
+	// another process sharing the directory
+	other, err := NewFileStore(s.Root)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	pair, err := s.AtomicPut("key", []byte("1"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := other.AtomicPut("key", []byte("2"), nil); err != ErrKeyExists {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+	pair2, err := s.AtomicPut("key", []byte("2"), pair)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.AtomicPut("key", []byte("3"), pair); err != ErrKeyModified {
+		t.Fatalf("Expected ErrKeyModified, got %v", err)
+	}
+	if err := s.AtomicDelete("key", pair); err != ErrKeyModified {
+		t.Fatalf("Expected ErrKeyModified, got %v", err)
+	}
+	if err := s.AtomicDelete("key", pair2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+}
+
+func TestFileStoreWatchTree(t *testing.T) {
+	s := newTestFileStore(t)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	treeCh, err := s.WatchTree("prefix", stopCh)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	next := func() []string {
+		select {
+		case pairs := <-treeCh:
+			return pairKeys(pairs)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for WatchTree")
+			return nil
+		}
+	}
+	if keys := next(); len(keys) != 0 {
+		t.Fatalf("Got %v", keys)
+	}
+	if err := s.Put("prefix/vfoo", []byte("foo")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if keys := next(); !reflect.DeepEqual(keys, []string{"prefix/vfoo"}) {
+		t.Fatalf("Got %v", keys)
+	}
+	// a file written by another process
+	if err := ioutil.WriteFile(filepath.Join(s.Root, "prefix", "vbar"), []byte("bar"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if keys := next(); !reflect.DeepEqual(keys, []string{"prefix/vbar", "prefix/vfoo"}) {
+		t.Fatalf("Got %v", keys)
+	}
+	s.Close()
+	if _, ok := <-treeCh; ok {
+		t.Fatal("Expected WatchTree channel to be closed")
+	}
+}
+
+func TestFileStoreLockTakeOver(t *testing.T) {
+	s := newTestFileStore(t)
+	ttl := 150 * time.Millisecond
+	// a lock left by a crashed holder
+	if err := s.Put("lock", []byte("1")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(filepath.Join(s.Root, "lock"), old, old); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test
+	locker, _ := s.NewLock("lock", ttl)
+	lostCh, err := locker.Lock(nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	time.Sleep(400 * time.Millisecond)
+	select {
+	case <-lostCh:
+		t.Fatal("Expected the lock to be renewed")
+	default:
+	}
+	// the renewed lock is not taken over
+	stopCh := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(stopCh) })
+	other, _ := s.NewLock("lock", ttl)
+	if lost, err := other.Lock(stopCh); lost != nil || err != nil {
+		t.Fatalf("Expected Lock to be stopped, got %v (%v)", lost, err)
+	}
+	if err := locker.Unlock(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.Get("lock"); err != ErrKeyNotFound {
+		t.Fatal("Expected the lock to be released")
+	}
+}
+
+func TestFileStoreKvSource(t *testing.T) {
+	type FileStoreStruct struct {
+		Vfoo   string
+		Vmap   map[string]int
+		Vslice []string
+		Vptr   *BasicStruct
+	}
+	kv := &KvSource{Store: newTestFileStore(t), Prefix: "prefix", LockKey: "prefix/.lock"}
+	config := &FileStoreStruct{
+		Vfoo:   "foo",
+		Vmap:   map[string]int{"a/b": 1, "c": 2},
+		Vslice: []string{},
+		Vptr:   &BasicStruct{Bar1: "bar"},
+	}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config.Vmap = map[string]int{"c": 3}
+	config.Vptr = nil
+	if _, err := kv.SyncConfig(config, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded := &FileStoreStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, config)
+	}
+
+	config.Vfoo = "published"
+	if err := kv.PublishConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded = &FileStoreStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, config)
+	}
+}
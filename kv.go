@@ -1,14 +1,18 @@
 package staert
 
 import (
+	"bytes"
 	"encoding"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/containous/flaeg"
 	"github.com/docker/libkv"
@@ -21,17 +25,119 @@ import (
 // It supports Slices (and maybe Arrays). They must be sorted in the KvStore like this :
 // Key : ".../[sliceIndex]" -> Value
 type KvSource struct {
-	store.Store
-	Prefix string // like this "prefix" (without the /)
+	Store           KvStore       // a libkv store can be used with NewLibkvStore
+	Prefix          string        // like this "prefix" (without the /)
+	Overlays        []string      // prefixes loaded over Prefix by LoadConfig, in order, later ones overriding earlier ones key by key
+	KeepVersions    int           // number of versions kept by PublishConfig, including the current one (2 if not set)
+	Optimistic      bool          // StoreConfig and PublishConfig fail with a ConflictError if keys changed since the last LoadConfig, SyncConfig fails
+	LockKey         string        // if set, StoreConfig, SyncConfig and PublishConfig write while holding this lock
+	LockTTL         time.Duration // TTL of the lock, renewed while it is held (store default if not set)
+	LockTimeout     time.Duration // maximum time waiting for the lock (no limit if not set)
+	Author          string        // recorded in the history of the versions published by PublishConfig and Rollback
+	KeyEscaper      KeyEscaper    // escapes map keys (PercentKeyEscaper if not set)
+	SecretCipher    SecretCipher  // encrypts the fields tagged `secret:"true"` (required to store or load them)
+	ListConcurrency int           // maximum number of concurrent calls loading a tree, if the store does not list it at once (8 if not set)
+	lastIndexes     map[string]uint64
+}
+
+// ConflictError is returned by StoreConfig and PublishConfig, in Optimistic mode,
+// when keys were modified in the KV Store since the last LoadConfig
+type ConflictError struct {
+	Keys []string // contested keys, sorted
+}
+
+func (e *ConflictError) Error() string {
+	return "conflict on keys modified since the last load: " + strings.Join(e.Keys, ", ")
+}
+
+const (
+	// kvVersionKey is the key, under Prefix, of the version published by PublishConfig
+	kvVersionKey = ".version"
+	// kvVersionsDir is the directory, under Prefix, containing the versions published by PublishConfig
+	kvVersionsDir = ".versions"
+	// kvHistoryDir is the directory, under Prefix, containing the metadata of the versions published by PublishConfig
+	kvHistoryDir       = ".history"
+	kvHistoryAuthor    = "author"
+	kvHistoryTimestamp = "timestamp"
+	// defaultKeepVersions is the default number of versions kept by PublishConfig
+	defaultKeepVersions = 2
+	// kvLoadAttempts is the number of times a layer is listed again when its version is replaced while listing it
+	kvLoadAttempts = 5
+	// defaultListConcurrency is the default maximum number of concurrent calls loading a tree
+	defaultListConcurrency = 8
+	// kvJSONPrefix prefixes the interface{} values encoded in JSON,
+	// so that the values stored as plain strings (like by the previous releases) are still loaded as strings
+	kvJSONPrefix = "json:"
+)
+
+// KvPlan is the list of the changes of keys planned by Plan, in the order they are made
+type KvPlan []KvChange
+
+// String renders the plan, one change per line, followed by a summary
+func (p KvPlan) String() string {
+	if len(p) == 0 {
+		return "No changes.\n"
+	}
+	count := map[KvOp]int{}
+	var buf bytes.Buffer
+	for _, change := range p {
+		count[change.Op]++
+		buf.WriteString(change.String())
+		buf.WriteString("\n")
+	}
+	fmt.Fprintf(&buf, "Plan: %d to create, %d to update, %d to delete.\n", count[KvCreate], count[KvUpdate], count[KvDelete])
+	return buf.String()
+}
+
+// Revision is a version published by PublishConfig or Rollback
+type Revision struct {
+	Version   int
+	Author    string
+	Timestamp time.Time
+	Current   bool // loaded by LoadConfig
+}
+
+// KvOp is the operation changing a key
+type KvOp string
+
+// Operations changing a key
+const (
+	KvCreate KvOp = "create"
+	KvUpdate KvOp = "update"
+	KvDelete KvOp = "delete"
+)
+
+// KvChange is the change of a key between two configurations
+type KvChange struct {
+	Op       KvOp
+	Key      string
+	OldValue string
+	NewValue string
+}
+
+func (c KvChange) String() string {
+	switch c.Op {
+	case KvCreate:
+		return fmt.Sprintf("+ %s = %q", c.Key, c.NewValue)
+	case KvDelete:
+		return fmt.Sprintf("- %s = %q", c.Key, c.OldValue)
+	default:
+		return fmt.Sprintf("~ %s = %q -> %q", c.Key, c.OldValue, c.NewValue)
+	}
 }
 
 // NewKvSource creates a new KvSource
 func NewKvSource(backend store.Backend, addrs []string, options *store.Config, prefix string) (*KvSource, error) {
 	kvStore, err := libkv.NewStore(backend, addrs, options)
-	return &KvSource{Store: kvStore, Prefix: prefix}, err
+	libkvStore := &LibkvStore{
+		Store:     kvStore,
+		TTL:       libkvTTLBackends[backend],
+		Recursive: libkvRecursiveBackends[backend],
+	}
+	return &KvSource{Store: libkvStore, Prefix: prefix}, err
 }
 
-// Parse uses libkv and mapstructure to fill the structure
+// Parse uses the KvStore and mapstructure to fill the structure
 func (kv *KvSource) Parse(cmd *flaeg.Command) (*flaeg.Command, error) {
 	err := kv.LoadConfig(cmd.Config)
 	if err != nil {
@@ -41,17 +147,62 @@ func (kv *KvSource) Parse(cmd *flaeg.Command) (*flaeg.Command, error) {
 }
 
 // LoadConfig loads data from the KV Store into the config structure (given by reference)
+// If a version has been published by PublishConfig, it is loaded instead of the keys under Prefix
+// The keys under Overlays are merged over the ones under Prefix, in order, each key overriding the same key of the previous prefixes.
+// The LastIndex of every loaded key is kept, to detect conflicts in Optimistic mode
 func (kv *KvSource) LoadConfig(config interface{}) error {
-	pairs := map[string][]byte{}
-	if err := kv.ListRecursive(kv.Prefix, pairs); err != nil {
+	kv.lastIndexes = map[string]uint64{}
+	return kv.loadConfig(config, "", reflect.Value{})
+}
+
+// LoadPath loads only the keys under path (relative to Prefix, like "pointerfield/floatfield") into the config structure (given by reference),
+// replacing the value at path, and leaving the other fields of the config unchanged
+// It follows the versions and the Overlays like LoadConfig. It fails if there is no key under path, or if path is under an element of a slice or array
+// (the whole slice must be loaded). A path under a map entry or an interface{} field loads the whole entry or field.
+func (kv *KvSource) LoadPath(config interface{}, path string) error {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return errors.New("empty path")
+	}
+	path, target, err := kvPathTarget(reflect.ValueOf(config), strings.Split(path, "/"))
+	if err != nil {
 		return err
 	}
+	if kv.lastIndexes == nil {
+		kv.lastIndexes = map[string]uint64{}
+	}
+	return kv.loadConfig(config, path, target)
+}
+
+// loadConfig loads the keys under path (all the keys if empty) into config, replacing target if it is valid
+func (kv *KvSource) loadConfig(config interface{}, path string, target reflect.Value) error {
+	pairs := map[string]*KvPair{}
+	for _, prefix := range append([]string{kv.Prefix}, kv.Overlays...) {
+		if err := kv.loadLayer(prefix, path, pairs); err != nil {
+			return err
+		}
+	}
+	slicePairs := make([]*KvPair, 0, len(pairs))
+	for _, pair := range pairs {
+		slicePairs = append(slicePairs, pair)
+	}
+	if len(path) > 0 && len(pairs) == 0 {
+		return fmt.Errorf("no key at path %s", path)
+	}
+	if target.IsValid() && target.CanSet() {
+		// mapstructure merges into maps and slices : the keys deleted from the KV Store must not be kept
+		target.Set(reflect.Zero(target.Type()))
+	}
 	// fmt.Printf("pairs : %#v\n", pairs)
-	mapStruct, err := generateMapstructure(convertPairs(pairs), kv.Prefix)
+	mapStruct, err := generateMapstructure(slicePairs, "")
 	if err != nil {
 		return err
 	}
 	// fmt.Printf("mapStruct : %#v\n", mapStruct)
+	renamed, err := renameKvKeys(reflect.TypeOf(config), mapStruct, kv.codec(), "")
+	if err != nil {
+		return err
+	}
 	configDecoder := &mapstructure.DecoderConfig{
 		Metadata:         nil,
 		Result:           config,
@@ -62,13 +213,182 @@ func (kv *KvSource) LoadConfig(config interface{}) error {
 	if err != nil {
 		return err
 	}
-	if err := decoder.Decode(mapStruct); err != nil {
+	if err := decoder.Decode(renamed); err != nil {
+		return err
+	}
+	return nil
+}
+
+// kvPathTarget returns the path of the KV keys of segments to load into config, and the value of config it replaces (invalid if none)
+// A path under a map entry or an interface{} is widened to it : mapstructure replaces a map entry as a whole,
+// and can not decode into an interface{} holding a value. It fails if the path is under an element of a slice or array.
+func kvPathTarget(config reflect.Value, segments []string) (string, reflect.Value, error) {
+	valueType, value := config.Type(), config
+	for i, segment := range segments {
+		for valueType.Kind() == reflect.Ptr {
+			valueType = valueType.Elem()
+			if value.IsValid() && value.IsNil() {
+				// nothing to replace below a nil pointer
+				value = reflect.Value{}
+			} else if value.IsValid() {
+				value = value.Elem()
+			}
+		}
+		switch valueType.Kind() {
+		case reflect.Slice, reflect.Array:
+			slicePath := strings.Join(segments[:i], "/")
+			return "", reflect.Value{}, fmt.Errorf("cannot load path %s under an element of the slice %s: load %s", strings.Join(segments, "/"), slicePath, slicePath)
+		case reflect.Map:
+			return strings.Join(segments[:i+1], "/"), reflect.Value{}, nil
+		case reflect.Interface:
+			return strings.Join(segments[:i], "/"), value, nil
+		case reflect.Struct:
+			field, ok := kvStructField(valueType, segment)
+			if !ok {
+				return strings.Join(segments, "/"), reflect.Value{}, nil
+			}
+			valueType = field.Type
+			if value.IsValid() {
+				value = value.FieldByIndex(field.Index)
+			}
+		default:
+			return strings.Join(segments, "/"), reflect.Value{}, nil
+		}
+	}
+	return strings.Join(segments, "/"), value, nil
+}
+
+// kvStructField returns the field of structType stored at the KV key name (in any casing), with its index from structType
+func kvStructField(structType reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.Name[:1] != strings.ToUpper(field.Name[:1]) {
+			continue
+		}
+		tag := parseKvTag(field)
+		if tag.skip {
+			continue
+		}
+		if tag.squash && field.Type.Kind() == reflect.Struct {
+			if squashed, ok := kvStructField(field.Type, name); ok {
+				squashed.Index = append([]int{i}, squashed.Index...)
+				return squashed, true
+			}
+			continue
+		}
+		if strings.EqualFold(tag.name, name) {
+			field.Index = []int{i}
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// loadLayer lists the keys under path of prefix (or of its published version) into pairs, by key relative to prefix
+// If another version is published while listing, the listed version may be deleted : the new version is listed instead.
+func (kv *KvSource) loadLayer(prefix string, path string, pairs map[string]*KvPair) error {
+	var version int
+	var versionPair *KvPair
+	var root string
+	var listed map[string]*KvPair
+	for attempt := 0; ; attempt++ {
+		var err error
+		version, versionPair, err = kv.layerVersion(prefix)
+		if err != nil {
+			return err
+		}
+		root = prefix
+		if version > 0 {
+			root = layerVersionPrefix(prefix, version)
+		}
+		listKey := root
+		if len(path) > 0 {
+			listKey = root + "/" + path
+		}
+		listed = map[string]*KvPair{}
+		if err := kv.listRecursive(listKey, listed); err != nil {
+			return err
+		}
+		if version == 0 {
+			break
+		}
+		current, _, err := kv.layerVersion(prefix)
+		if err != nil {
+			return err
+		}
+		if current == version {
+			break
+		}
+		if attempt+1 >= kvLoadAttempts {
+			return fmt.Errorf("cannot load %s: version %d was replaced by version %d while loading it, %d times", prefix, version, current, kvLoadAttempts)
+		}
+	}
+	if len(path) > 0 {
+		// the keys under path deleted since the last load are not loaded anymore
+		for key := range kv.lastIndexes {
+			if isUnder(root+"/"+path, key) {
+				delete(kv.lastIndexes, key)
+			}
+		}
+	}
+	for key, pair := range listed {
+		kv.lastIndexes[key] = pair.LastIndex
+		relative := strings.TrimPrefix(strings.Trim(key, "/"), strings.Trim(root, "/")+"/")
+		pairs[relative] = &KvPair{Key: relative, Value: pair.Value, LastIndex: pair.LastIndex}
+	}
+	if versionPair != nil {
+		kv.lastIndexes[versionPair.Key] = versionPair.LastIndex
+	}
+	return nil
+}
+
+// currentVersion returns the version published by PublishConfig and its version key, or 0 and nil
+func (kv *KvSource) currentVersion() (int, *KvPair, error) {
+	return kv.layerVersion(kv.Prefix)
+}
+
+// layerVersion returns the version published under prefix and its version key, or 0 and nil
+func (kv *KvSource) layerVersion(prefix string) (int, *KvPair, error) {
+	pair, err := kv.Store.Get(prefix + "/" + kvVersionKey)
+	if err == ErrKeyNotFound {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	version, err := strconv.Atoi(string(pair.Value))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid version %q in %s: %v", pair.Value, pair.Key, err)
+	}
+	return version, pair, nil
+}
+
+// checkUnpublished fails if a version was published by PublishConfig :
+// LoadConfig loads it, so the keys written under Prefix would never be loaded
+func (kv *KvSource) checkUnpublished() error {
+	version, _, err := kv.currentVersion()
+	if err != nil {
 		return err
 	}
+	if version > 0 {
+		return fmt.Errorf("version %d is published under %s, the config can only be changed by PublishConfig", version, kv.Prefix)
+	}
 	return nil
 }
 
-func generateMapstructure(pairs []*store.KVPair, prefix string) (map[string]interface{}, error) {
+func (kv *KvSource) versionKey() string {
+	return kv.Prefix + "/" + kvVersionKey
+}
+
+func (kv *KvSource) versionPrefix(version int) string {
+	return layerVersionPrefix(kv.Prefix, version)
+}
+
+func layerVersionPrefix(prefix string, version int) string {
+	return prefix + "/" + kvVersionsDir + "/" + strconv.Itoa(version)
+}
+
+func generateMapstructure(pairs []*KvPair, prefix string) (map[string]interface{}, error) {
 	raw := make(map[string]interface{})
 	for _, p := range pairs {
 		// Trim the prefix off our key first
@@ -91,7 +411,8 @@ func processKV(key string, v []byte, raw map[string]interface{}) (map[string]int
 		key = children[len(children)-1]
 		children = children[:len(children)-1]
 		for _, child := range children {
-			if m[child] == nil {
+			// an empty value is a directory key (like the ones of pointers)
+			if m[child] == nil || m[child] == "" {
 				m[child] = make(map[string]interface{})
 			}
 			subm, ok := m[child].(map[string]interface{})
@@ -101,18 +422,267 @@ func processKV(key string, v []byte, raw map[string]interface{}) (map[string]int
 			m = subm
 		}
 	}
+	if _, isDir := m[key].(map[string]interface{}); isDir && len(v) == 0 {
+		return raw, nil
+	}
 	m[key] = string(v)
 	return raw, nil
 }
 
-func decodeHook(fromType reflect.Type, toType reflect.Type, data interface{}) (interface{}, error) {
-	// TODO : Array support
+// kvTag is the parsed kv struct tag of a field, like `kv:"name,squash,omitempty"`, `kv:",json,ttl=30s"` or `kv:"-"`
+type kvTag struct {
+	name      string // KV key of the field
+	fieldName string // name of the field for mapstructure
+	squash    bool   // squashed in the KV Store
+	msSquash  bool   // squashed by mapstructure
+	omitEmpty bool
+	json      bool   // stored as a single JSON value
+	secret    bool   // values encrypted by the SecretCipher
+	ttl       string // TTL of the keys, like "30s"
+	skip      bool
+}
+
+// parseKvTag parses the kv and mapstructure tags of field
+// The KV key is the kv tag name, else the mapstructure tag name, else the lowercased field name.
+func parseKvTag(field reflect.StructField) kvTag {
+	tag := kvTag{name: strings.ToLower(field.Name), fieldName: field.Name}
+	msParts := strings.Split(field.Tag.Get("mapstructure"), ",")
+	if len(msParts[0]) > 0 {
+		tag.name = msParts[0]
+		tag.fieldName = msParts[0]
+	}
+	kvParts := strings.Split(field.Tag.Get("kv"), ",")
+	if len(kvParts[0]) > 0 {
+		tag.name = kvParts[0]
+	}
+	tag.skip = tag.name == "-" || msParts[0] == "-"
+	tag.secret = field.Tag.Get("secret") == "true"
+	for _, option := range msParts[1:] {
+		tag.msSquash = tag.msSquash || option == "squash"
+	}
+	tag.squash = tag.msSquash
+	for _, option := range kvParts[1:] {
+		switch option {
+		case "squash":
+			tag.squash = true
+		case "omitempty":
+			tag.omitEmpty = true
+		case "json":
+			tag.json = true
+		default:
+			if strings.HasPrefix(option, "ttl=") {
+				tag.ttl = strings.TrimPrefix(option, "ttl=")
+			}
+		}
+	}
+	return tag
+}
+
+// renameKvKeys renames the KV keys of data (generated by generateMapstructure) to the field names mapstructure expects
+// when decoding into toType, following the kv tags. Unknown keys are dropped.
+// Map keys are unescaped, and unmarshaled if their type implements encoding.TextUnmarshaler.
+// path is the KV key of data, relative to the config.
+func renameKvKeys(toType reflect.Type, data interface{}, codec *kvCodec, path string) (interface{}, error) {
+	for toType.Kind() == reflect.Ptr {
+		toType = toType.Elem()
+	}
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+	switch toType.Kind() {
+	case reflect.Struct:
+		out := make(map[string]interface{})
+		if err := renameKvFields(toType, dataMap, out, codec, path); err != nil {
+			return nil, err
+		}
+		return out, nil
+	case reflect.Map:
+		if isTextUnmarshalerKey(toType.Key()) {
+			return unmarshalKvKeys(toType, dataMap, codec, path)
+		}
+		out := make(map[string]interface{}, len(dataMap))
+		for key, value := range dataMap {
+			renamed, err := renameKvKeys(toType.Elem(), value, codec, kvPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			out[codec.escaper.Unescape(key)] = renamed
+		}
+		return out, nil
+	case reflect.Slice, reflect.Array:
+		out := make(map[string]interface{}, len(dataMap))
+		for key, value := range dataMap {
+			renamed, err := renameKvKeys(toType.Elem(), value, codec, kvPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			out[key] = renamed
+		}
+		return out, nil
+	}
+	return data, nil
+}
+
+// isTextUnmarshalerKey returns true if map keys of type keyType are unmarshaled with encoding.TextUnmarshaler
+func isTextUnmarshalerKey(keyType reflect.Type) bool {
+	textUnmarshalerType := reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	return keyType.Kind() != reflect.Ptr && reflect.PtrTo(keyType).Implements(textUnmarshalerType)
+}
+
+// unmarshalKvKeys returns a map with the keys of dataMap unmarshaled into the key type of mapType,
+// which mapstructure can decode into a map of mapType
+func unmarshalKvKeys(mapType reflect.Type, dataMap map[string]interface{}, codec *kvCodec, path string) (interface{}, error) {
+	out := reflect.MakeMapWithSize(reflect.MapOf(mapType.Key(), reflect.TypeOf((*interface{})(nil)).Elem()), len(dataMap))
+	for key, value := range dataMap {
+		mapKey := reflect.New(mapType.Key())
+		if err := mapKey.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(codec.escaper.Unescape(key))); err != nil {
+			return nil, fmt.Errorf("error unmarshaling map key %s: %v", key, err)
+		}
+		renamed, err := renameKvKeys(mapType.Elem(), value, codec, kvPath(path, key))
+		if err != nil {
+			return nil, err
+		}
+		if renamed == nil {
+			out.SetMapIndex(mapKey.Elem(), reflect.Zero(out.Type().Elem()))
+		} else {
+			out.SetMapIndex(mapKey.Elem(), reflect.ValueOf(renamed))
+		}
+	}
+	return out.Interface(), nil
+}
+
+// renameKvFields puts into out the values of dataMap (at the KV key path), renamed for the fields of structType
+func renameKvFields(structType reflect.Type, dataMap map[string]interface{}, out map[string]interface{}, codec *kvCodec, path string) error {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.Name[:1] != strings.ToUpper(field.Name[:1]) {
+			//if unexported field
+			continue
+		}
+		tag := parseKvTag(field)
+		if tag.skip {
+			continue
+		}
+		if tag.squash && field.Type.Kind() == reflect.Struct {
+			if tag.msSquash {
+				if err := renameKvFields(field.Type, dataMap, out, codec, path); err != nil {
+					return err
+				}
+			} else {
+				// only squashed in the KV Store
+				squashed := make(map[string]interface{})
+				if err := renameKvFields(field.Type, dataMap, squashed, codec, path); err != nil {
+					return err
+				}
+				out[tag.fieldName] = squashed
+			}
+			continue
+		}
+		key := tag.name
+		value, ok := dataMap[key]
+		if !ok {
+			// keys stored in another casing
+			for k, v := range dataMap {
+				if strings.EqualFold(k, tag.name) {
+					key, value, ok = k, v, true
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		fieldPath := kvPath(path, key)
+		fieldCodec := codec
+		if tag.secret && !codec.secret {
+			if codec.cipher == nil {
+				return fmt.Errorf("secret field %s requires a SecretCipher", field.Name)
+			}
+			decrypted, err := decryptKvData(value, codec.cipher, fieldPath)
+			if err != nil {
+				return fmt.Errorf("error decrypting field %s: %v", field.Name, err)
+			}
+			value = decrypted
+			// nested secret fields are already decrypted
+			fieldCodec = &kvCodec{escaper: codec.escaper, secret: true}
+		}
+		if jsonValue, isString := value.(string); tag.json && isString {
+			decoded := reflect.New(field.Type)
+			if err := json.Unmarshal([]byte(jsonValue), decoded.Interface()); err != nil {
+				return fmt.Errorf("error decoding JSON of field %s: %v", field.Name, err)
+			}
+			if data := newKvDecoded(decoded.Elem()); data != nil {
+				out[tag.fieldName] = data
+			}
+			continue
+		}
+		// not stored in JSON
+		renamed, err := renameKvKeys(field.Type, value, fieldCodec, fieldPath)
+		if err != nil {
+			return err
+		}
+		out[tag.fieldName] = renamed
+	}
+	return nil
+}
+
+// kvPath returns the KV key of key under path
+func kvPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "/" + key
+}
+
+// kvDecoded is a value already decoded into the type of its field (like a field tagged `kv:",json"`), set as is by decodeHook
+// mapstructure would turn its nil maps and slices into empty ones.
+type kvDecoded struct {
+	value reflect.Value
+}
+
+// newKvDecoded returns the data of value for mapstructure : nil if value is nil, so that nothing is set
+func newKvDecoded(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+	}
+	return kvDecoded{value: value}
+}
+
+// data returns the data decoded by mapstructure : pointers, maps, slices and arrays element by element,
+// so that mapstructure sets each element as is, and the other values as is
+func (d kvDecoded) data() interface{} {
+	switch d.value.Kind() {
+	case reflect.Ptr:
+		return newKvDecoded(d.value.Elem())
+	case reflect.Map:
+		data := make(map[interface{}]interface{}, d.value.Len())
+		for _, key := range d.value.MapKeys() {
+			data[key.Interface()] = newKvDecoded(d.value.MapIndex(key))
+		}
+		return data
+	case reflect.Slice, reflect.Array:
+		data := make([]interface{}, d.value.Len())
+		for i := range data {
+			data[i] = newKvDecoded(d.value.Index(i))
+		}
+		return data
+	}
+	return d.value.Interface()
+}
 
+func decodeHook(fromType reflect.Type, toType reflect.Type, data interface{}) (interface{}, error) {
+	if decoded, ok := data.(kvDecoded); ok {
+		return decoded.data(), nil
+	}
 	// custom unmarshaler
 	textUnmarshalerType := reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
-	if toType.Implements(textUnmarshalerType) {
+	if text, ok := data.(string); ok && toType.Implements(textUnmarshalerType) {
 		object := reflect.New(toType.Elem()).Interface()
-		err := object.(encoding.TextUnmarshaler).UnmarshalText([]byte(data.(string)))
+		err := object.(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
 		if err != nil {
 			return nil, fmt.Errorf("error unmarshaling %v: %v", data, err)
 		}
@@ -120,12 +690,58 @@ func decodeHook(fromType reflect.Type, toType reflect.Type, data interface{}) (i
 	}
 	switch toType.Kind() {
 	case reflect.Ptr:
-		if fromType.Kind() == reflect.String {
+		if fromType.Kind() == reflect.String && toType.Elem().Kind() == reflect.Struct {
 			if data == "" {
 				// default value Pointer
 				return make(map[string]interface{}), nil
 			}
 		}
+	case reflect.Map:
+		if fromType.Kind() == reflect.String && data == "" {
+			// empty map
+			return make(map[string]interface{}), nil
+		}
+	case reflect.Interface:
+		if text, ok := data.(string); ok && strings.HasPrefix(text, kvJSONPrefix) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(text, kvJSONPrefix)), &value); err != nil {
+				return nil, fmt.Errorf("error decoding JSON %q: %v", text, err)
+			}
+			return value, nil
+		}
+	case reflect.Array:
+		if fromType.Kind() == reflect.Map {
+			dataMap, ok := data.(map[string]interface{})
+			if !ok {
+				return data, fmt.Errorf("input data is not a map : %#v", data)
+			}
+			// missing indexes are left to the zero value
+			dataOutput := make([]interface{}, toType.Len())
+			for k, v := range dataMap {
+				ind, err := strconv.Atoi(k)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index %q for array %s", k, toType)
+				}
+				if ind < 0 || ind >= toType.Len() {
+					return nil, fmt.Errorf("index %d out of bounds of array %s", ind, toType)
+				}
+				dataOutput[ind] = v
+			}
+			return dataOutput, nil
+		} else if fromType.Kind() == reflect.String && toType.Elem().Kind() == reflect.Uint8 {
+			b, err := base64.StdEncoding.DecodeString(data.(string))
+			if err != nil {
+				return nil, err
+			}
+			if len(b) > toType.Len() {
+				return nil, fmt.Errorf("%d bytes out of bounds of array %s", len(b), toType)
+			}
+			dataOutput := make([]interface{}, len(b))
+			for i := range b {
+				dataOutput[i] = b[i]
+			}
+			return dataOutput, nil
+		}
 	case reflect.Slice:
 		if fromType.Kind() == reflect.Map {
 			// Type assertion
@@ -155,6 +771,10 @@ func decodeHook(fromType reflect.Type, toType reflect.Type, data interface{}) (i
 
 			return dataOutput, nil
 		} else if fromType.Kind() == reflect.String {
+			if toType.Elem().Kind() != reflect.Uint8 && data == "" {
+				// empty slice
+				return []interface{}{}, nil
+			}
 			b, err := base64.StdEncoding.DecodeString(data.(string))
 			if err != nil {
 				return nil, err
@@ -166,75 +786,863 @@ func decodeHook(fromType reflect.Type, toType reflect.Type, data interface{}) (i
 }
 
 // StoreConfig stores the config into the KV Store
+// The keys of the fields tagged with a ttl, like `kv:",ttl=30s"`, expire after it.
 func (kv *KvSource) StoreConfig(config interface{}) error {
-	kvMap := map[string]string{}
-	if err := collateKvRecursive(reflect.ValueOf(config), kvMap, kv.Prefix); err != nil {
+	return kv.StoreConfigTTL(config, 0)
+}
+
+// StoreConfigTTL stores the config into the KV Store, its keys expiring after ttl (unless their field is tagged with another ttl)
+// Ephemeral keys can be kept alive with KeepAlive.
+func (kv *KvSource) StoreConfigTTL(config interface{}, ttl time.Duration) error {
+	kvMap, ttls, err := kv.collateTTLs(config, kv.Prefix, ttl)
+	if err != nil {
 		return err
 	}
-	var keys []string
-	for key := range kvMap {
-		keys = append(keys, key)
+	if kv.Optimistic && len(ttls) > 0 {
+		return errors.New("keys with a TTL can not be stored in Optimistic mode")
 	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		var writeOptions *store.WriteOptions
-		// is it a directory ?
-		if strings.HasSuffix(k, "/") {
-			writeOptions = &store.WriteOptions{
-				IsDir: true,
-			}
-		}
-		if err := kv.Put(k, []byte(kvMap[k]), writeOptions); err != nil {
+	return kv.withLock(func() error {
+		if err := kv.checkUnpublished(); err != nil {
 			return err
 		}
-	}
-	return nil
+		if kv.Optimistic {
+			return kv.storeKvMapAtomic(kvMap)
+		}
+		return kv.storeKvMapTTL(kvMap, ttls)
+	})
 }
 
-func collateKvRecursive(objValue reflect.Value, kv map[string]string, key string) error {
-	name := key
-	kind := objValue.Kind()
+// StoreField stores only the keys of the config under path (relative to Prefix, like "pointerfield/floatfield") into the KV Store,
+// and the directories leading to it
+// The other keys are not written. It fails if the config has no key under path.
+func (kv *KvSource) StoreField(config interface{}, path string) error {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return errors.New("empty path")
+	}
+	kvMap, ttls, err := kv.collateTTLs(config, kv.Prefix, 0)
+	if err != nil {
+		return err
+	}
+	fieldMap := fieldKvMap(kvMap, kv.Prefix+"/"+path)
+	if len(fieldMap) == 0 {
+		return fmt.Errorf("no key at path %s", path)
+	}
+	if kv.Optimistic && len(ttls) > 0 {
+		return errors.New("keys with a TTL can not be stored in Optimistic mode")
+	}
+	return kv.withLock(func() error {
+		if err := kv.checkUnpublished(); err != nil {
+			return err
+		}
+		if kv.Optimistic {
+			return kv.storeKvMapAtomic(fieldMap)
+		}
+		return kv.storeKvMapTTL(fieldMap, ttls)
+	})
+}
 
-	// custom marshaler
-	if marshaler, ok := objValue.Interface().(encoding.TextMarshaler); ok {
-		test, err := marshaler.MarshalText()
-		if err != nil {
-			return fmt.Errorf("error marshaling key %s: %v", name, err)
+// fieldKvMap returns the keys of kvMap under path (or path itself), and the directory keys of kvMap leading to path,
+// or nil if there is no key under path
+func fieldKvMap(kvMap map[string]string, path string) map[string]string {
+	fieldMap := map[string]string{}
+	found := false
+	for key, value := range kvMap {
+		if isUnder(path, key) {
+			fieldMap[key] = value
+			found = true
+		} else if strings.HasSuffix(key, "/") && isUnder(key, path) {
+			fieldMap[key] = value
 		}
-		kv[name] = string(test)
+	}
+	if !found {
 		return nil
 	}
-	switch kind {
-	case reflect.Struct:
-		for i := 0; i < objValue.NumField(); i++ {
-			objType := objValue.Type()
-			if objType.Field(i).Name[:1] != strings.ToUpper(objType.Field(i).Name[:1]) {
-				//if unexported field
-				continue
-			}
-			squashed := false
-			if objType.Field(i).Anonymous {
-				if objValue.Field(i).Kind() == reflect.Struct {
-					tags := objType.Field(i).Tag
-					if strings.Contains(string(tags), "squash") {
-						squashed = true
-					}
-				}
-			}
-			if squashed {
-				if err := collateKvRecursive(objValue.Field(i), kv, name); err != nil {
-					return err
-				}
+	return fieldMap
+}
+
+// KeepAlive stores the config into the KV Store like StoreConfigTTL, then stores it again before its keys expire, until stopCh is closed
+// The config is encoded once : changes made to it afterwards are not stored. Optimistic mode is ignored.
+func (kv *KvSource) KeepAlive(config interface{}, ttl time.Duration, stopCh <-chan struct{}) error {
+	kvMap, ttls, err := kv.collateTTLs(config, kv.Prefix, ttl)
+	if err != nil {
+		return err
+	}
+	if len(ttls) == 0 {
+		return errors.New("no TTL to keep alive")
+	}
+	// refreshed 3 times per TTL, so that a slow refresh does not let keys expire
+	var interval time.Duration
+	for _, keyTTL := range ttls {
+		if interval == 0 || keyTTL/3 < interval {
+			interval = keyTTL / 3
+		}
+	}
+	for {
+		err := kv.withLock(func() error {
+			if err := kv.checkUnpublished(); err != nil {
+				return err
+			}
+			return kv.storeKvMapTTL(kvMap, ttls)
+		})
+		if err != nil {
+			return err
+		}
+		select {
+		case <-stopCh:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// SyncConfig stores the config into the KV Store, then deletes the stale keys under Prefix:
+// keys which are not generated from the config anymore (removed map entries, shortened slices, nil pointers...)
+// The lock, and the versions published by PublishConfig and their history are never stale.
+// It returns the stale keys, sorted. With dryRun, nothing is written nor deleted.
+// It fails in Optimistic mode (except with dryRun) : KvStore can not delete a key only if it is unchanged.
+func (kv *KvSource) SyncConfig(config interface{}, dryRun bool) ([]string, error) {
+	if kv.Optimistic && !dryRun {
+		return nil, errors.New("SyncConfig can not be used in Optimistic mode: stale keys can not be deleted atomically")
+	}
+	kvMap, ttls, err := kv.collateTTLs(config, kv.Prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return kv.syncKvMap(kvMap, ttls, dryRun)
+	}
+	var stale []string
+	err = kv.withLock(func() error {
+		var err error
+		stale, err = kv.syncKvMap(kvMap, ttls, dryRun)
+		return err
+	})
+	return stale, err
+}
+
+// syncKvMap puts the keys of kvMap into the KV Store and deletes the stale keys under Prefix
+func (kv *KvSource) syncKvMap(kvMap map[string]string, ttls map[string]time.Duration, dryRun bool) ([]string, error) {
+	if err := kv.checkUnpublished(); err != nil {
+		return nil, err
+	}
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive(kv.Prefix, pairs); err != nil {
+		return nil, err
+	}
+	for key := range pairs {
+		if kv.isMetadataKey(key) {
+			delete(pairs, key)
+		}
+	}
+	stale := staleKeys(pairs, kvMap)
+	if dryRun {
+		return stale, nil
+	}
+	if err := kv.storeKvMapTTL(kvMap, ttls); err != nil {
+		return nil, err
+	}
+	for _, key := range stale {
+		if err := kv.Store.Delete(key); err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+	}
+	return stale, nil
+}
+
+// Plan returns the changes SyncConfig would make to the keys under Prefix to store the config, without writing anything :
+// the keys created or updated, in lexical order, then the stale keys deleted, in lexical order
+func (kv *KvSource) Plan(config interface{}) (KvPlan, error) {
+	kvMap, err := kv.collate(config, kv.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.checkUnpublished(); err != nil {
+		return nil, err
+	}
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive(kv.Prefix, pairs); err != nil {
+		return nil, err
+	}
+	current := map[string]string{}
+	for key, value := range pairs {
+		if kv.isMetadataKey(key) {
+			delete(pairs, key)
+			continue
+		}
+		current[key] = string(value)
+	}
+	var plan KvPlan
+	for _, change := range diffKvMaps(current, kvMap) {
+		// encrypted again with another nonce
+		sameSecret := change.Op == KvUpdate && kv.sameSecret(change.Key, change.OldValue, change.NewValue)
+		if change.Op != KvDelete && !sameSecret {
+			plan = append(plan, change)
+		}
+	}
+	// the directories of the stored keys are kept, like SyncConfig does
+	for _, key := range staleKeys(pairs, kvMap) {
+		plan = append(plan, KvChange{Op: KvDelete, Key: key, OldValue: current[key]})
+	}
+	return plan, nil
+}
+
+// sameSecret returns true if oldValue and newValue are the same value of key encrypted by SecretCipher
+func (kv *KvSource) sameSecret(key string, oldValue, newValue string) bool {
+	if kv.SecretCipher == nil {
+		return false
+	}
+	key = strings.TrimPrefix(key, strings.Trim(kv.Prefix, "/")+"/")
+	oldPlain, err := kv.SecretCipher.Decrypt(key, oldValue)
+	if err != nil {
+		return false
+	}
+	newPlain, err := kv.SecretCipher.Decrypt(key, newValue)
+	return err == nil && bytes.Equal(oldPlain, newPlain)
+}
+
+// PublishConfig stores the config into the KV Store atomically :
+// the config is written and verified under a new version directory, then the version key is switched to it.
+// Readers using LoadConfig get either the previous config or the new one, never a mix of both.
+// Once a version is published, the other writes (StoreConfig, StoreField, SyncConfig, KeepAlive) fail.
+// Old versions are deleted, keeping KeepVersions versions.
+// In Optimistic mode, it fails with a ConflictError if a version was published since the last LoadConfig.
+func (kv *KvSource) PublishConfig(config interface{}) error {
+	return kv.withLock(func() error {
+		return kv.publishConfig(config)
+	})
+}
+
+func (kv *KvSource) publishConfig(config interface{}) error {
+	version, previous, err := kv.nextVersion()
+	if err != nil {
+		return err
+	}
+	kvMap, err := kv.collate(config, kv.versionPrefix(version))
+	if err != nil {
+		return err
+	}
+	return kv.publishKvMap(version, previous, kvMap)
+}
+
+// nextVersion returns the version to publish, and the version key expected by putVersion
+// In Optimistic mode, it fails with a ConflictError if a version was published since the last LoadConfig.
+func (kv *KvSource) nextVersion() (int, *KvPair, error) {
+	current, currentPair, err := kv.currentVersion()
+	if err != nil {
+		return 0, nil, err
+	}
+	if kv.Optimistic {
+		lastIndex, loaded := kv.lastIndexes[kv.versionKey()]
+		if (currentPair != nil) != loaded || (loaded && currentPair.LastIndex != lastIndex) {
+			return 0, nil, &ConflictError{Keys: []string{kv.versionKey()}}
+		}
+	}
+	return current + 1, currentPair, nil
+}
+
+// publishKvMap writes kvMap (with keys under the version prefix), verifies it, records its history,
+// then switches the version key to it
+func (kv *KvSource) publishKvMap(version int, previous *KvPair, kvMap map[string]string) error {
+	prefix := kv.versionPrefix(version)
+	// remove the leftovers of a failed publication
+	if err := kv.deleteVersion(version); err != nil {
+		return err
+	}
+	if err := kv.storeKvMap(kvMap); err != nil {
+		return err
+	}
+	if err := kv.verifyKvMap(prefix, kvMap); err != nil {
+		return kv.abortVersion(version, err)
+	}
+	if err := kv.putHistory(version); err != nil {
+		return kv.abortVersion(version, err)
+	}
+	if err := kv.putVersion(version, previous); err != nil {
+		return kv.abortVersion(version, err)
+	}
+	return kv.deleteOldVersions(version)
+}
+
+// abortVersion deletes the version which failed to be published with err
+func (kv *KvSource) abortVersion(version int, err error) error {
+	if errDelete := kv.deleteVersion(version); errDelete != nil {
+		return fmt.Errorf("%v (and deleting version %d failed: %v)", err, version, errDelete)
+	}
+	return err
+}
+
+// deleteVersion deletes the config and the history of version
+func (kv *KvSource) deleteVersion(version int) error {
+	for _, prefix := range []string{kv.versionPrefix(version), kv.historyPrefix(version)} {
+		if err := kv.Store.DeleteTree(prefix); err != nil && err != ErrKeyNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// putVersion switches the version key to version
+// In Optimistic mode, the version key must not have changed since previous was read
+func (kv *KvSource) putVersion(version int, previous *KvPair) error {
+	value := []byte(strconv.Itoa(version))
+	if !kv.Optimistic {
+		return kv.Store.Put(kv.versionKey(), value)
+	}
+	pair, err := kv.Store.AtomicPut(kv.versionKey(), value, previous)
+	if err == ErrKeyModified || err == ErrKeyExists || err == ErrKeyNotFound {
+		return &ConflictError{Keys: []string{kv.versionKey()}}
+	}
+	if err != nil {
+		return err
+	}
+	if kv.lastIndexes != nil && pair != nil {
+		kv.lastIndexes[pair.Key] = pair.LastIndex
+	}
+	return nil
+}
+
+// withLock runs write while holding LockKey, if set
+// It fails if the lock can not be acquired within LockTimeout, or if the lock is lost during write.
+func (kv *KvSource) withLock(write func() error) error {
+	if len(kv.LockKey) == 0 {
+		return write()
+	}
+	kvLocker, ok := kv.Store.(KvLocker)
+	if !ok {
+		return fmt.Errorf("cannot create lock %s: locks not supported by the store", kv.LockKey)
+	}
+	locker, err := kvLocker.NewLock(kv.LockKey, kv.LockTTL)
+	if err != nil {
+		return fmt.Errorf("cannot create lock %s: %v", kv.LockKey, err)
+	}
+	stopCh := make(chan struct{})
+	var timer *time.Timer
+	if kv.LockTimeout > 0 {
+		timer = time.AfterFunc(kv.LockTimeout, func() { close(stopCh) })
+	}
+	lostCh, err := locker.Lock(stopCh)
+	if err != nil {
+		return fmt.Errorf("cannot acquire lock %s: %v", kv.LockKey, err)
+	}
+	if lostCh != nil && timer != nil && !timer.Stop() {
+		// acquired after the timeout
+		locker.Unlock()
+		lostCh = nil
+	}
+	if lostCh == nil {
+		return fmt.Errorf("timeout acquiring lock %s after %s", kv.LockKey, kv.LockTimeout)
+	}
+
+	err = write()
+	select {
+	case <-lostCh:
+		if err == nil {
+			err = fmt.Errorf("lock %s lost while writing", kv.LockKey)
+		}
+	default:
+	}
+	if errUnlock := locker.Unlock(); errUnlock != nil && err == nil {
+		err = fmt.Errorf("cannot release lock %s: %v", kv.LockKey, errUnlock)
+	}
+	return err
+}
+
+// verifyKvMap checks that the keys under prefix are exactly the keys of kvMap
+func (kv *KvSource) verifyKvMap(prefix string, kvMap map[string]string) error {
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive(prefix, pairs); err != nil {
+		return err
+	}
+	stored := map[string]string{}
+	for key, value := range pairs {
+		stored[strings.Trim(key, "/")] = string(value)
+	}
+	for key, value := range kvMap {
+		storedValue, ok := stored[strings.Trim(key, "/")]
+		if !ok && len(value) == 0 && strings.HasSuffix(key, "/") {
+			// directories may not be listed
+			continue
+		}
+		if !ok || storedValue != value {
+			return fmt.Errorf("verification failed on key %s", key)
+		}
+	}
+	return nil
+}
+
+// deleteOldVersions deletes the versions older than the KeepVersions last ones
+func (kv *KvSource) deleteOldVersions(version int) error {
+	keep := kv.KeepVersions
+	if keep <= 0 {
+		keep = defaultKeepVersions
+	}
+	versions, err := kv.listVersions()
+	if err != nil {
+		return err
+	}
+	for _, old := range versions {
+		if old > version-keep {
+			break
+		}
+		if err := kv.deleteVersion(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listVersions returns the versions stored under the versions directory, sorted
+func (kv *KvSource) listVersions() ([]int, error) {
+	versionsPrefix := kv.Prefix + "/" + kvVersionsDir
+	pairs, err := kv.Store.List(versionsPrefix)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	listed := map[int]bool{}
+	for _, pair := range pairs {
+		name := strings.Split(strings.TrimPrefix(strings.Trim(pair.Key, "/"), versionsPrefix+"/"), "/")[0]
+		version, err := strconv.Atoi(name)
+		if err != nil || listed[version] {
+			continue
+		}
+		versions = append(versions, version)
+		listed[version] = true
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+func (kv *KvSource) historyPrefix(version int) string {
+	return kv.Prefix + "/" + kvHistoryDir + "/" + strconv.Itoa(version)
+}
+
+// putHistory records the author and the time of the publication of version
+func (kv *KvSource) putHistory(version int) error {
+	prefix := kv.historyPrefix(version)
+	if err := kv.Store.Put(prefix+"/"+kvHistoryAuthor, []byte(kv.Author)); err != nil {
+		return err
+	}
+	return kv.Store.Put(prefix+"/"+kvHistoryTimestamp, []byte(time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+// Revisions returns the kept versions published by PublishConfig, oldest first
+func (kv *KvSource) Revisions() ([]Revision, error) {
+	current, _, err := kv.currentVersion()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := kv.listVersions()
+	if err != nil {
+		return nil, err
+	}
+	var revisions []Revision
+	for _, version := range versions {
+		if version > current {
+			// not published
+			continue
+		}
+		revision := Revision{Version: version, Current: version == current}
+		prefix := kv.historyPrefix(version)
+		pair, err := kv.Store.Get(prefix + "/" + kvHistoryAuthor)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		if pair != nil {
+			revision.Author = string(pair.Value)
+		}
+		pair, err = kv.Store.Get(prefix + "/" + kvHistoryTimestamp)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		if pair != nil {
+			if revision.Timestamp, err = time.Parse(time.RFC3339Nano, string(pair.Value)); err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q in %s: %v", pair.Value, pair.Key, err)
+			}
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// DiffRevisions returns the changes of the keys from the version from to the version to, sorted by key
+// Keys are relative to the versions.
+func (kv *KvSource) DiffRevisions(from, to int) ([]KvChange, error) {
+	fromMap, err := kv.readVersion(from)
+	if err != nil {
+		return nil, err
+	}
+	toMap, err := kv.readVersion(to)
+	if err != nil {
+		return nil, err
+	}
+	return diffKvMaps(fromMap, toMap), nil
+}
+
+// Rollback publishes again the config of version, as a new version
+func (kv *KvSource) Rollback(version int) error {
+	return kv.withLock(func() error {
+		relMap, err := kv.readVersion(version)
+		if err != nil {
+			return err
+		}
+		next, previous, err := kv.nextVersion()
+		if err != nil {
+			return err
+		}
+		kvMap := make(map[string]string, len(relMap))
+		for key, value := range relMap {
+			kvMap[kv.versionPrefix(next)+"/"+key] = value
+		}
+		return kv.publishKvMap(next, previous, kvMap)
+	})
+}
+
+// readVersion returns the keys of version, relative to its prefix
+func (kv *KvSource) readVersion(version int) (map[string]string, error) {
+	prefix := kv.versionPrefix(version)
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive(prefix, pairs); err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("revision %d not found", version)
+	}
+	kvMap := make(map[string]string, len(pairs))
+	for key, value := range pairs {
+		// keep the trailing / of directories
+		kvMap[strings.TrimPrefix(strings.TrimPrefix(key, "/"), strings.Trim(prefix, "/")+"/")] = string(value)
+	}
+	return kvMap, nil
+}
+
+// diffKvMaps returns the changes from oldMap to newMap, sorted by key
+func diffKvMaps(oldMap, newMap map[string]string) []KvChange {
+	var changes []KvChange
+	for key, oldValue := range oldMap {
+		newValue, ok := newMap[key]
+		if !ok {
+			changes = append(changes, KvChange{Op: KvDelete, Key: key, OldValue: oldValue})
+		} else if newValue != oldValue {
+			changes = append(changes, KvChange{Op: KvUpdate, Key: key, OldValue: oldValue, NewValue: newValue})
+		}
+	}
+	for key, newValue := range newMap {
+		if _, ok := oldMap[key]; !ok {
+			changes = append(changes, KvChange{Op: KvCreate, Key: key, NewValue: newValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// staleKeys returns the sorted keys of pairs which are neither a key of kvMap, nor a directory of one of them
+func staleKeys(pairs map[string][]byte, kvMap map[string]string) []string {
+	live := map[string]bool{}
+	for key := range kvMap {
+		key = strings.Trim(key, "/")
+		for len(key) > 0 && !live[key] {
+			live[key] = true
+			if i := strings.LastIndex(key, "/"); i >= 0 {
+				key = key[:i]
 			} else {
-				fieldName := objType.Field(i).Name
-				//useless if not empty Prefix is required ?
-				if len(key) == 0 {
-					name = strings.ToLower(fieldName)
-				} else {
-					name = key + "/" + strings.ToLower(fieldName)
-				}
+				key = ""
+			}
+		}
+	}
+	var stale []string
+	for key := range pairs {
+		if !live[strings.Trim(key, "/")] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// isMetadataKey returns true if key is not a key of the config, but the lock, or a key of the versions published under Prefix or of their history
+func (kv *KvSource) isMetadataKey(key string) bool {
+	metadata := []string{kv.Prefix + "/" + kvVersionKey, kv.Prefix + "/" + kvVersionsDir, kv.Prefix + "/" + kvHistoryDir}
+	if len(kv.LockKey) > 0 {
+		metadata = append(metadata, strings.Trim(kv.LockKey, "/"))
+	}
+	key = strings.Trim(key, "/")
+	for _, metadataKey := range metadata {
+		if key == metadataKey || strings.HasPrefix(key, metadataKey+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// storeKvMap puts the keys of kvMap into the KV Store, in lexical order
+func (kv *KvSource) storeKvMap(kvMap map[string]string) error {
+	return kv.storeKvMapTTL(kvMap, nil)
+}
+
+// storeKvMapTTL puts the keys of kvMap into the KV Store, in lexical order, with the TTL of their longest prefix in ttls
+func (kv *KvSource) storeKvMapTTL(kvMap map[string]string, ttls map[string]time.Duration) error {
+	var keys []string
+	for key := range kvMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// checked before writing, so that nothing is written if a key can not expire
+	ttlStore, ok := kv.Store.(KvTTLStore)
+	if checker, isChecker := kv.Store.(interface{ SupportsTTL() bool }); isChecker && !checker.SupportsTTL() {
+		ok = false
+	}
+	for _, k := range keys {
+		if keyTTL(k, ttls) > 0 && !ok {
+			return fmt.Errorf("cannot store %s with a TTL: %v", k, ErrTTLNotSupported)
+		}
+	}
+	for _, k := range keys {
+		ttl := keyTTL(k, ttls)
+		if ttl == 0 {
+			if err := kv.Store.Put(k, []byte(kvMap[k])); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ttlStore.PutTTL(k, []byte(kvMap[k]), ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyTTL returns the TTL of key : the one of its longest prefix (or itself) in ttls, 0 if none
+func keyTTL(key string, ttls map[string]time.Duration) time.Duration {
+	key = strings.TrimSuffix(key, "/")
+	for len(ttls) > 0 {
+		if ttl, ok := ttls[key]; ok {
+			return ttl
+		}
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			return 0
+		}
+		key = key[:i]
+	}
+	return 0
+}
+
+// storeKvMapAtomic puts the keys of kvMap into the KV Store, in lexical order, with AtomicPut :
+// a key must be unchanged since the last LoadConfig, or still missing if it was not loaded.
+// Keys already holding their value are not written. Every key is checked before writing, so that nothing is written when a conflict is already visible.
+func (kv *KvSource) storeKvMapAtomic(kvMap map[string]string) error {
+	var keys []string
+	for key := range kvMap {
+		// directories have no value to protect
+		if !strings.HasSuffix(key, "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var contested []string
+	// keys already holding their value
+	stored := map[string]*KvPair{}
+	for _, k := range keys {
+		pair, err := kv.Store.Get(k)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		lastIndex, loaded := kv.lastIndexes[k]
+		exists := err == nil
+		if exists && string(pair.Value) == kvMap[k] {
+			stored[k] = pair
+			continue
+		}
+		if exists != loaded || (exists && pair.LastIndex != lastIndex) {
+			contested = append(contested, k)
+		}
+	}
+	if len(contested) > 0 {
+		return &ConflictError{Keys: contested}
+	}
+	if kv.lastIndexes == nil {
+		kv.lastIndexes = map[string]uint64{}
+	}
+	dirs := map[string]string{}
+	for key, value := range kvMap {
+		if strings.HasSuffix(key, "/") {
+			dirs[key] = value
+		}
+	}
+	if err := kv.storeKvMap(dirs); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if pair, ok := stored[k]; ok {
+			// unchanged keys are not written, so that they do not conflict with other writers
+			kv.lastIndexes[k] = pair.LastIndex
+			continue
+		}
+		var previous *KvPair
+		if lastIndex, loaded := kv.lastIndexes[k]; loaded {
+			previous = &KvPair{Key: k, LastIndex: lastIndex}
+		}
+		pair, err := kv.Store.AtomicPut(k, []byte(kvMap[k]), previous)
+		if err == ErrKeyModified || err == ErrKeyExists || err == ErrKeyNotFound {
+			// modified between the check and the write
+			contested = append(contested, k)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if pair != nil {
+			kv.lastIndexes[k] = pair.LastIndex
+		}
+	}
+	if len(contested) > 0 {
+		return &ConflictError{Keys: contested}
+	}
+	return nil
+}
 
-				if err := collateKvRecursive(objValue.Field(i), kv, name); err != nil {
+// collate returns the keys and values encoding config under prefix
+func (kv *KvSource) collate(config interface{}, prefix string) (map[string]string, error) {
+	kvMap, _, err := kv.collateTTLs(config, prefix, 0)
+	return kvMap, err
+}
+
+// collateTTLs returns the keys and values encoding config under prefix, and the TTLs of the keys by prefix :
+// ttl for prefix (if not 0), and the ttl of the fields tagged with one
+func (kv *KvSource) collateTTLs(config interface{}, prefix string, ttl time.Duration) (map[string]string, map[string]time.Duration, error) {
+	kvMap := map[string]string{}
+	codec := kv.codec()
+	codec.root = prefix
+	codec.ttls = map[string]time.Duration{}
+	if ttl > 0 {
+		codec.ttls[strings.Trim(prefix, "/")] = ttl
+	}
+	if err := collateKvEscaped(reflect.ValueOf(config), kvMap, prefix, codec); err != nil {
+		return nil, nil, err
+	}
+	return kvMap, codec.ttls, nil
+}
+
+// collateKvRecursive puts into kv the keys and values encoding objValue under key, the root of the config
+// The root pointer is not stored as a directory.
+func collateKvRecursive(objValue reflect.Value, kv map[string]string, key string) error {
+	return collateKvEscaped(objValue, kv, key, &kvCodec{escaper: PercentKeyEscaper})
+}
+
+// collateKvEscaped is collateKvRecursive, encoding keys and values with codec
+func collateKvEscaped(objValue reflect.Value, kv map[string]string, key string, codec *kvCodec) error {
+	if objValue.Kind() == reflect.Ptr && !objValue.IsNil() && !isTextMarshaler(objValue) {
+		objValue = objValue.Elem()
+	}
+	return collateKv(objValue, kv, key, codec)
+}
+
+// kvCodec holds the settings encoding the config into keys and values of the KV Store, and decoding it
+type kvCodec struct {
+	escaper KeyEscaper
+	cipher  SecretCipher
+	secret  bool   // inside a secret field, encrypted or decrypted as a whole
+	root    string // key of the config, the keys of the encrypted values are relative to it
+	// TTLs of the fields tagged with a ttl, by key, filled while collating
+	ttls map[string]time.Duration
+}
+
+// codec returns the kvCodec of the KvSource settings
+func (kv *KvSource) codec() *kvCodec {
+	return &kvCodec{escaper: kv.keyEscaper(), cipher: kv.SecretCipher}
+}
+
+// collateKvJSON puts objValue into kv as a single JSON value, nothing if it is nil
+func collateKvJSON(objValue reflect.Value, kv map[string]string, name string) error {
+	switch objValue.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		if objValue.IsNil() {
+			return nil
+		}
+	}
+	value, err := json.Marshal(objValue.Interface())
+	if err != nil {
+		return fmt.Errorf("error encoding JSON of key %s: %v", name, err)
+	}
+	kv[name] = string(value)
+	return nil
+}
+
+// collateKv puts into kv the keys and values encoding objValue under name :
+//   - structs : a key per field (see parseKvTag), a single JSON value for the fields tagged `kv:",json"`
+//   - pointers : nothing if nil, else the pointed value, with a directory key "name/" if it is a struct
+//   - maps and slices : nothing if nil, else a directory key "name/", and a key per entry ("name/<escaped map key>" or "name/<index>")
+//   - byte slices : the value encoded in base64
+//   - interfaces : the value encoded in JSON
+//   - encoding.TextMarshaler : the marshaled text
+//   - other kinds : the value formatted with strconv
+func collateKv(objValue reflect.Value, kv map[string]string, name string, codec *kvCodec) error {
+	kind := objValue.Kind()
+
+	// custom marshaler
+	if isTextMarshaler(objValue) {
+		test, err := objValue.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return fmt.Errorf("error marshaling key %s: %v", name, err)
+		}
+		kv[name] = string(test)
+		return nil
+	}
+	switch kind {
+	case reflect.Struct:
+		for i := 0; i < objValue.NumField(); i++ {
+			objType := objValue.Type()
+			if objType.Field(i).Name[:1] != strings.ToUpper(objType.Field(i).Name[:1]) {
+				//if unexported field
+				continue
+			}
+			tag := parseKvTag(objType.Field(i))
+			if tag.skip || (tag.omitEmpty && objValue.Field(i).IsZero()) {
+				continue
+			}
+			if tag.squash && objValue.Field(i).Kind() == reflect.Struct {
+				if err := collateKv(objValue.Field(i), kv, name, codec); err != nil {
+					return err
+				}
+				continue
+			}
+			fieldName := tag.name
+			//useless if not empty Prefix is required ?
+			if len(name) > 0 {
+				fieldName = name + "/" + tag.name
+			}
+			if len(tag.ttl) > 0 {
+				ttl, err := time.ParseDuration(tag.ttl)
+				if err != nil || ttl <= 0 {
+					return fmt.Errorf("invalid ttl %q of field %s", tag.ttl, fieldName)
+				}
+				if codec.ttls != nil {
+					codec.ttls[fieldName] = ttl
+				}
+			}
+			target, fieldCodec := kv, codec
+			if tag.secret && !codec.secret {
+				if codec.cipher == nil {
+					return fmt.Errorf("secret field %s requires a SecretCipher", fieldName)
+				}
+				// encrypted once collated, with the nested secret fields
+				target = map[string]string{}
+				fieldCodec = &kvCodec{escaper: codec.escaper, secret: true, ttls: codec.ttls}
+			}
+			if tag.json {
+				if err := collateKvJSON(objValue.Field(i), target, fieldName); err != nil {
+					return err
+				}
+			} else if err := collateKv(objValue.Field(i), target, fieldName, fieldCodec); err != nil {
+				return err
+			}
+			if fieldCodec != codec {
+				if err := encryptKvMap(target, kv, codec.cipher, codec.root); err != nil {
 					return err
 				}
 			}
@@ -242,43 +1650,70 @@ func collateKvRecursive(objValue reflect.Value, kv map[string]string, key string
 
 	case reflect.Ptr:
 		if !objValue.IsNil() {
-			// hack to avoid calling this at the beginning
-			if len(kv) > 0 {
+			if objValue.Elem().Kind() == reflect.Struct && !isTextMarshaler(objValue.Elem()) {
 				kv[name+"/"] = ""
 			}
-			if err := collateKvRecursive(objValue.Elem(), kv, name); err != nil {
+			if err := collateKv(objValue.Elem(), kv, name, codec); err != nil {
 				return err
 			}
 		}
 	case reflect.Map:
+		if objValue.IsNil() {
+			return nil
+		}
+		kv[name+"/"] = ""
 		for _, k := range objValue.MapKeys() {
-			if k.Kind() == reflect.Struct {
-				return errors.New("struct as key not supported")
+			mapKey, err := formatMapKey(k)
+			if err != nil {
+				return err
+			}
+			if len(mapKey) == 0 {
+				return fmt.Errorf("empty map key not supported in %s", name)
 			}
-			name = key + "/" + fmt.Sprint(k)
-			if err := collateKvRecursive(objValue.MapIndex(k), kv, name); err != nil {
+			if err := collateKvElem(objValue.MapIndex(k), kv, name+"/"+codec.escaper.Escape(mapKey), codec); err != nil {
 				return err
 			}
 		}
 	case reflect.Array, reflect.Slice:
+		if kind == reflect.Slice && objValue.IsNil() {
+			return nil
+		}
 		// Byte slices get special treatment
 		if objValue.Type().Elem().Kind() == reflect.Uint8 {
-			kv[name] = base64.StdEncoding.EncodeToString(objValue.Bytes())
+			b := make([]byte, objValue.Len())
+			reflect.Copy(reflect.ValueOf(b), objValue)
+			kv[name] = base64.StdEncoding.EncodeToString(b)
+		} else if kind == reflect.Slice {
+			kv[name+"/"] = ""
+			for i := 0; i < objValue.Len(); i++ {
+				if err := collateKvElem(objValue.Index(i), kv, name+"/"+strconv.Itoa(i), codec); err != nil {
+					return err
+				}
+			}
 		} else {
+			// missing indexes are loaded as zero values, so nil elements are not stored
 			for i := 0; i < objValue.Len(); i++ {
-				name = key + "/" + strconv.Itoa(i)
-				if err := collateKvRecursive(objValue.Index(i), kv, name); err != nil {
+				if err := collateKv(objValue.Index(i), kv, name+"/"+strconv.Itoa(i), codec); err != nil {
 					return err
 				}
 			}
 		}
-	case reflect.Interface, reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16,
+	case reflect.Interface:
+		if _, ok := kv[name]; ok {
+			return errors.New("key already exists: " + name)
+		}
+		data, err := json.Marshal(objValue.Interface())
+		if err != nil {
+			return fmt.Errorf("error marshaling key %s: %v", name, err)
+		}
+		kv[name] = kvJSONPrefix + string(data)
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16,
 		reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
 		reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64:
 		if _, ok := kv[name]; ok {
 			return errors.New("key already exists: " + name)
 		}
-		kv[name] = fmt.Sprint(objValue)
+		kv[name] = formatScalar(objValue)
 
 	default:
 		return fmt.Errorf("kind %s not supported", kind.String())
@@ -286,44 +1721,170 @@ func collateKvRecursive(objValue reflect.Value, kv map[string]string, key string
 	return nil
 }
 
+// collateKvElem puts into kv the keys and values encoding the element of a map or a slice
+// A nil element can not be stored, as it could not be told apart from a missing one.
+func collateKvElem(objValue reflect.Value, kv map[string]string, name string, codec *kvCodec) error {
+	switch objValue.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if objValue.IsNil() {
+			return fmt.Errorf("nil element not supported: %s", name)
+		}
+	}
+	return collateKv(objValue, kv, name, codec)
+}
+
+// formatMapKey returns the text of a map key : the marshaled text for encoding.TextMarshaler, else the formatted value
+func formatMapKey(k reflect.Value) (string, error) {
+	if isTextMarshaler(k) {
+		text, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return "", fmt.Errorf("error marshaling map key %v: %v", k, err)
+		}
+		return string(text), nil
+	}
+	if k.Kind() == reflect.Struct {
+		return "", errors.New("struct as key not supported")
+	}
+	return fmt.Sprint(k), nil
+}
+
+func isTextMarshaler(objValue reflect.Value) bool {
+	if objValue.Kind() == reflect.Ptr && objValue.IsNil() || !objValue.CanInterface() {
+		return false
+	}
+	_, ok := objValue.Interface().(encoding.TextMarshaler)
+	return ok
+}
+
+// formatScalar formats the value of a scalar kind, so that it can be parsed back exactly
+// Methods of the type (like String) are ignored.
+func formatScalar(objValue reflect.Value) string {
+	switch objValue.Kind() {
+	case reflect.String:
+		return objValue.String()
+	case reflect.Bool:
+		return strconv.FormatBool(objValue.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(objValue.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(objValue.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(objValue.Float(), 'g', -1, 32)
+	default:
+		return strconv.FormatFloat(objValue.Float(), 'g', -1, 64)
+	}
+}
+
 // ListRecursive lists all key value children under key
 func (kv *KvSource) ListRecursive(key string, pairs map[string][]byte) error {
-	pairsN1, err := kv.List(key, nil)
-	if err == store.ErrKeyNotFound {
+	kvPairs := map[string]*KvPair{}
+	if err := kv.listRecursive(key, kvPairs); err != nil {
+		return err
+	}
+	for k, pair := range kvPairs {
+		pairs[k] = pair.Value
+	}
+	return nil
+}
+
+// listRecursive lists all key value children under key, keeping their LastIndex
+// If the store lists every key under key at once (ListsRecursively, like MemStore or Consul), a single List is issued.
+// Otherwise, the tree is walked with up to ListConcurrency concurrent calls.
+func (kv *KvSource) listRecursive(key string, pairs map[string]*KvPair) error {
+	pairsN1, err := kv.Store.List(key)
+	if err == ErrKeyNotFound {
 		return nil
 	}
 	if err != nil {
 		return err
 	}
 	if len(pairsN1) == 0 {
-		pairLeaf, err := kv.Get(key, nil)
+		pairLeaf, err := kv.Store.Get(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		if pairLeaf == nil {
-			return nil
-		}
-		pairs[pairLeaf.Key] = pairLeaf.Value
+		pairs[pairLeaf.Key] = pairLeaf
 		return nil
 	}
-	for _, p := range pairsN1 {
-		err := kv.ListRecursive(p.Key, pairs)
-		if err != nil {
-			return err
+	if lister, isLister := kv.Store.(interface{ ListsRecursively() bool }); isLister && lister.ListsRecursively() {
+		for _, p := range pairsN1 {
+			if isUnder(key, p.Key) {
+				pairs[p.Key] = p
+			}
 		}
+		return nil
 	}
-	return nil
+	concurrency := kv.ListConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultListConcurrency
+	}
+	walker := &kvWalker{
+		store:   kv.Store,
+		sem:     make(chan struct{}, concurrency),
+		pairs:   pairs,
+		visited: map[string]bool{key: true},
+	}
+	walker.mu.Lock()
+	walker.walkChildren(key, pairsN1)
+	walker.mu.Unlock()
+	walker.wg.Wait()
+	return walker.err
+}
+
+// isUnder returns true if child is key or under key (and not only prefixed by key, like "prefix2" for "prefix")
+func isUnder(key, child string) bool {
+	key = strings.Trim(key, "/")
+	child = strings.Trim(child, "/")
+	return child == key || strings.HasPrefix(child, key+"/")
+}
+
+// kvWalker walks a tree of the KV Store, with a bounded number of concurrent calls
+type kvWalker struct {
+	store   KvStore
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	pairs   map[string]*KvPair
+	visited map[string]bool
+	err     error
+}
+
+// walk lists the key value children under key, or the key value itself if it has no children
+func (w *kvWalker) walk(key string) {
+	defer w.wg.Done()
+	w.sem <- struct{}{}
+	children, err := w.store.List(key)
+	var leaf *KvPair
+	if err == nil && len(children) == 0 {
+		leaf, err = w.store.Get(key)
+	}
+	<-w.sem
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == ErrKeyNotFound || w.err != nil {
+		return
+	}
+	if err != nil {
+		w.err = err
+		return
+	}
+	if leaf != nil {
+		w.pairs[leaf.Key] = leaf
+	}
+	w.walkChildren(key, children)
 }
 
-func convertPairs(pairs map[string][]byte) []*store.KVPair {
-	slicePairs := make([]*store.KVPair, len(pairs))
-	i := 0
-	for k, v := range pairs {
-		slicePairs[i] = &store.KVPair{
-			Key:   k,
-			Value: v,
+// walkChildren walks the children of key which are not visited yet, w.mu must be held
+func (w *kvWalker) walkChildren(key string, children []*KvPair) {
+	for _, child := range children {
+		if isUnder(key, child.Key) && !w.visited[child.Key] {
+			w.visited[child.Key] = true
+			w.wg.Add(1)
+			go w.walk(child.Key)
 		}
-		i++
 	}
-	return slicePairs
 }
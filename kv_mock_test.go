@@ -12,10 +12,20 @@ type Mock struct {
 	Error           bool
 	KVPairs         []*store.KVPair
 	WatchTreeMethod func() <-chan []*store.KVPair
+	lastIndex       uint64
+	locks           map[string]chan struct{}
 }
 
 func (s *Mock) Put(key string, value []byte, opts *store.WriteOptions) error {
-	s.KVPairs = append(s.KVPairs, &store.KVPair{Key: key, Value: value, LastIndex: 0})
+	s.lastIndex++
+	for _, kvPair := range s.KVPairs {
+		if kvPair.Key == key {
+			kvPair.Value = value
+			kvPair.LastIndex = s.lastIndex
+			return nil
+		}
+	}
+	s.KVPairs = append(s.KVPairs, &store.KVPair{Key: key, Value: value, LastIndex: s.lastIndex})
 	return nil
 }
 
@@ -32,7 +42,16 @@ func (s *Mock) Get(key string, options *store.ReadOptions) (*store.KVPair, error
 }
 
 func (s *Mock) Delete(key string) error {
-	return errors.New("delete not supported")
+	if s.Error {
+		return errors.New("error")
+	}
+	for i, kvPair := range s.KVPairs {
+		if kvPair.Key == key {
+			s.KVPairs = append(s.KVPairs[:i], s.KVPairs[i+1:]...)
+			return nil
+		}
+	}
+	return store.ErrKeyNotFound
 }
 
 // Exists mock
@@ -52,7 +71,39 @@ func (s *Mock) WatchTree(prefix string, stopCh <-chan struct{}, options *store.R
 
 // NewLock mock
 func (s *Mock) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
-	return nil, errors.New("NewLock not supported")
+	if s.Error {
+		return nil, errors.New("error")
+	}
+	if s.locks == nil {
+		s.locks = map[string]chan struct{}{}
+	}
+	if s.locks[key] == nil {
+		s.locks[key] = make(chan struct{}, 1)
+	}
+	return &mockLock{held: s.locks[key]}, nil
+}
+
+// mockLock is a process-local lock, shared by the locks created with the same key
+type mockLock struct {
+	held chan struct{}
+}
+
+func (l *mockLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	select {
+	case l.held <- struct{}{}:
+		return make(chan struct{}), nil
+	case <-stopChan:
+		return nil, nil
+	}
+}
+
+func (l *mockLock) Unlock() error {
+	select {
+	case <-l.held:
+		return nil
+	default:
+		return errors.New("not locked")
+	}
 }
 
 // List mock
@@ -78,12 +129,36 @@ func (s *Mock) List(prefix string, options *store.ReadOptions) ([]*store.KVPair,
 
 // DeleteTree mock
 func (s *Mock) DeleteTree(prefix string) error {
-	return errors.New("DeleteTree not supported")
+	if s.Error {
+		return errors.New("error")
+	}
+	var kv []*store.KVPair
+	for _, kvPair := range s.KVPairs {
+		if kvPair.Key != prefix && !strings.HasPrefix(kvPair.Key, prefix+"/") {
+			kv = append(kv, kvPair)
+		}
+	}
+	s.KVPairs = kv
+	return nil
 }
 
 // AtomicPut mock
 func (s *Mock) AtomicPut(key string, value []byte, previous *store.KVPair, opts *store.WriteOptions) (bool, *store.KVPair, error) {
-	return false, nil, errors.New("AtomicPut not supported")
+	if s.Error {
+		return false, nil, errors.New("error")
+	}
+	pair, _ := s.Get(key, nil)
+	if previous == nil && pair != nil {
+		return false, nil, store.ErrKeyExists
+	}
+	if previous != nil && (pair == nil || pair.LastIndex != previous.LastIndex) {
+		return false, nil, store.ErrKeyModified
+	}
+	if err := s.Put(key, value, opts); err != nil {
+		return false, nil, err
+	}
+	pair, err := s.Get(key, nil)
+	return true, pair, err
 }
 
 // AtomicDelete mock
@@ -1,10 +1,21 @@
 package staert
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"github.com/containous/flaeg"
@@ -13,7 +24,7 @@ import (
 )
 
 func TestGenerateMapstructureBasic(t *testing.T) {
-	moke := []*store.KVPair{
+	moke := []*KvPair{
 		{Key: "test/addr", Value: []byte("foo")},
 		{Key: "test/child/data", Value: []byte("bar")}}
 	prefix := "test"
@@ -35,7 +46,7 @@ func TestGenerateMapstructureBasic(t *testing.T) {
 }
 
 func TestGenerateMapstructureTrivialMap(t *testing.T) {
-	moke := []*store.KVPair{
+	moke := []*KvPair{
 		{Key: "test/vfoo", Value: []byte("foo")},
 		{Key: "test/vother/foo", Value: []byte("foo")},
 		{Key: "test/vother/bar", Value: []byte("bar")},
@@ -60,7 +71,7 @@ func TestGenerateMapstructureTrivialMap(t *testing.T) {
 }
 
 func TestGenerateMapstructureTrivialSlice(t *testing.T) {
-	moke := []*store.KVPair{
+	moke := []*KvPair{
 		{Key: "test/vfoo", Value: []byte("foo")},
 		{Key: "test/vother/0", Value: []byte("foo")},
 		{Key: "test/vother/1", Value: []byte("bar1")},
@@ -87,7 +98,7 @@ func TestGenerateMapstructureTrivialSlice(t *testing.T) {
 }
 
 func TestGenerateMapstructureNotTrivialSlice(t *testing.T) {
-	moke := []*store.KVPair{
+	moke := []*KvPair{
 		{Key: "test/vfoo", Value: []byte("foo")},
 		{Key: "test/vother/0/foo1", Value: []byte("bar")},
 		{Key: "test/vother/0/foo2", Value: []byte("bar")},
@@ -232,10 +243,10 @@ func TestKvSourceEmpty(t *testing.T) {
 	}
 	s := NewStaert(rootCmd)
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{},
-		},
-		"test/",
+		}),
+		Prefix: "test/",
 	}
 	s.AddSource(kv)
 
@@ -258,7 +269,7 @@ func TestKvSourceEmpty(t *testing.T) {
 }
 
 func TestGenerateMapstructureTrivial(t *testing.T) {
-	input := []*store.KVPair{
+	input := []*KvPair{
 		{Key: "test/ptrstruct1/s1int", Value: []byte("28")},
 		{Key: "test/durationfield", Value: []byte("28")},
 	}
@@ -396,13 +407,13 @@ func TestParseKvSourceTrivial(t *testing.T) {
 		Run: func() error { return nil },
 	}
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{
 				{Key: "test/ptrstruct1/s1int", Value: []byte("28")},
 				{Key: "test/durationfield", Value: []byte("28")},
 			},
-		},
-		"test",
+		}),
+		Prefix: "test",
 	}
 	if _, err := kv.Parse(rootCmd); err != nil {
 		t.Fatalf("Error %s", err)
@@ -434,7 +445,7 @@ func TestLoadConfigKvSourceNestedPtrsNil(t *testing.T) {
 
 	//Test
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{
 				{Key: "prefix/ptrstruct1/s1int", Value: []byte("1")},
 				{Key: "prefix/ptrstruct1/s1string", Value: []byte("S1StringInitConfig")},
@@ -442,8 +453,8 @@ func TestLoadConfigKvSourceNestedPtrsNil(t *testing.T) {
 				{Key: "prefix/ptrstruct1/s1ptrstruct3/s3float64", Value: []byte("0")},
 				{Key: "prefix/durationfield", Value: []byte("21000000000")},
 			},
-		},
-		"prefix",
+		}),
+		Prefix: "prefix",
 	}
 	if err := kv.LoadConfig(config); err != nil {
 		t.Fatalf("Error %s", err)
@@ -484,7 +495,7 @@ func TestParseKvSourceNestedPtrsNil(t *testing.T) {
 		Run: func() error { return nil },
 	}
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{
 				{Key: "prefix/ptrstruct1/s1int", Value: []byte("1")},
 				{Key: "prefix/ptrstruct1/s1string", Value: []byte("S1StringInitConfig")},
@@ -492,8 +503,8 @@ func TestParseKvSourceNestedPtrsNil(t *testing.T) {
 				{Key: "prefix/ptrstruct1/s1ptrstruct3/s3float64", Value: []byte("0")},
 				{Key: "prefix/durationfield", Value: []byte("21000000000")},
 			},
-		},
-		"prefix",
+		}),
+		Prefix: "prefix",
 	}
 	if _, err := kv.Parse(rootCmd); err != nil {
 		t.Fatalf("Error %s", err)
@@ -536,14 +547,14 @@ func TestParseKvSourceMap(t *testing.T) {
 		Run: func() error { return nil },
 	}
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{
 				{Key: "prefix/vmap/toto", Value: []byte("1")},
 				{Key: "prefix/vmap/tata", Value: []byte("2")},
 				{Key: "prefix/vmap/titi", Value: []byte("3")},
 			},
-		},
-		"prefix",
+		}),
+		Prefix: "prefix",
 	}
 	if _, err := kv.Parse(rootCmd); err != nil {
 		t.Fatalf("Error %v", err)
@@ -596,7 +607,7 @@ func TestCollateKvPairsBasic(t *testing.T) {
 		"prefix/vbool":   "true",
 		"prefix/vfloat":  "1.5",
 		"prefix/vextra":  "toto",
-		"prefix/vdata":   "42",
+		"prefix/vdata":   "json:42",
 		"prefix/vstring": "tata",
 		"prefix/vint":    "-15",
 		"prefix/vuint":   "51",
@@ -606,6 +617,41 @@ func TestCollateKvPairsBasic(t *testing.T) {
 	}
 }
 
+func TestLoadConfigInterface(t *testing.T) {
+	type InterfaceStruct struct {
+		Vlegacy interface{}
+		Vjson   interface{}
+	}
+	kv := &KvSource{
+		Store: NewLibkvStore(&Mock{
+			KVPairs: []*store.KVPair{
+				// written by a previous release
+				{Key: "prefix/vlegacy", Value: []byte("8080")},
+				{Key: "prefix/vjson", Value: []byte(`json:{"port":8080}`)},
+			},
+		}),
+		Prefix: "prefix",
+	}
+	config := &InterfaceStruct{}
+	if err := kv.LoadConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := &InterfaceStruct{
+		Vlegacy: "8080",
+		Vjson:   map[string]interface{}{"port": float64(8080)},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("Got: %#v\nExpected: %#v", config, expected)
+	}
+
+	if err := kv.Store.Put("prefix/vjson", []byte("json:{")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kv.LoadConfig(&InterfaceStruct{}); err == nil {
+		t.Fatal("Expected an error decoding invalid JSON")
+	}
+}
+
 func TestCollateKvPairsNestedPointers(t *testing.T) {
 	//init
 	config := &StructPtr{
@@ -625,6 +671,7 @@ func TestCollateKvPairsNestedPointers(t *testing.T) {
 
 	//check
 	expected := map[string]string{
+		"prefix/ptrstruct1/":                       "",
 		"prefix/ptrstruct1/s1int":                  "1",
 		"prefix/ptrstruct1/s1string":               "S1StringInitConfig",
 		"prefix/ptrstruct1/s1bool":                 "false",
@@ -658,6 +705,7 @@ func TestCollateKvPairsMapStringString(t *testing.T) {
 
 	//check
 	expected := map[string]string{
+		"prefix/vother/":   "",
 		"prefix/vother/k1": "v1",
 		"prefix/vother/k2": "v2",
 		"prefix/vfoo":      "toto",
@@ -688,6 +736,7 @@ func TestCollateKvPairsMapIntString(t *testing.T) {
 
 	//check
 	expected := map[string]string{
+		"prefix/vother/":   "",
 		"prefix/vother/51": "v1",
 		"prefix/vother/15": "v2",
 		"prefix/vfoo":      "toto",
@@ -724,6 +773,7 @@ func TestCollateKvPairsMapStringStruct(t *testing.T) {
 
 	//check
 	expected := map[string]string{
+		"prefix/vother/":            "",
 		"prefix/vother/k1/s1bool":   "true",
 		"prefix/vother/k1/s1int":    "51",
 		"prefix/vother/k1/s1string": "",
@@ -786,6 +836,7 @@ func TestCollateKvPairsSliceInt(t *testing.T) {
 
 	//check
 	expected := map[string]string{
+		"prefix/vother/":  "",
 		"prefix/vother/0": "51",
 		"prefix/vother/1": "15",
 		"prefix/vfoo":     "toto",
@@ -819,6 +870,7 @@ func TestCollateKvPairsSlicePtrOnStruct(t *testing.T) {
 
 	//check
 	expected := map[string]string{
+		"prefix/vother/":       "",
 		"prefix/vother/0/":     "",
 		"prefix/vother/0/bar1": "",
 		"prefix/vother/0/bar2": "",
@@ -921,8 +973,8 @@ func TestStoreConfigEmbeddedSquash(t *testing.T) {
 		Vfoo: "toto",
 	}
 	kv := &KvSource{
-		&Mock{},
-		"prefix",
+		Store:  NewLibkvStore(&Mock{}),
+		Prefix: "prefix",
 	}
 	//test
 	if err := kv.StoreConfig(config); err != nil {
@@ -1009,7 +1061,7 @@ func TestCollateKvPairsShortNameUnexported(t *testing.T) {
 
 func TestListRecursive5Levels(t *testing.T) {
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{
 				{Key: "prefix/l1", Value: []byte("level1")},
 				{Key: "prefix/d1/l1", Value: []byte("level2")},
@@ -1017,8 +1069,8 @@ func TestListRecursive5Levels(t *testing.T) {
 				{Key: "prefix/d2/d1/l1", Value: []byte("level3")},
 				{Key: "prefix/d3/d2/d1/d1/d1", Value: []byte("level5")},
 			},
-		},
-		"prefix",
+		}),
+		Prefix: "prefix",
 	}
 	pairs := map[string][]byte{}
 	err := kv.ListRecursive(kv.Prefix, pairs)
@@ -1046,10 +1098,10 @@ func TestListRecursive5Levels(t *testing.T) {
 
 func TestListRecursiveEmpty(t *testing.T) {
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{},
-		},
-		"prefix",
+		}),
+		Prefix: "prefix",
 	}
 	pairs := map[string][]byte{}
 	err := kv.ListRecursive(kv.Prefix, pairs)
@@ -1064,36 +1116,6 @@ func TestListRecursiveEmpty(t *testing.T) {
 	}
 }
 
-func TestConvertPairs5Levels(t *testing.T) {
-	input := map[string][]byte{
-		"prefix/l1":             []byte("level1"),
-		"prefix/d1/l1":          []byte("level2"),
-		"prefix/d1/l2":          []byte("level2"),
-		"prefix/d2/d1/l1":       []byte("level3"),
-		"prefix/d3/d2/d1/d1/d1": []byte("level5"),
-	}
-	//test
-	output := convertPairs(input)
-
-	//check
-	expected := map[string][]byte{
-		"prefix/l1":             []byte("level1"),
-		"prefix/d1/l1":          []byte("level2"),
-		"prefix/d1/l2":          []byte("level2"),
-		"prefix/d2/d1/l1":       []byte("level3"),
-		"prefix/d3/d2/d1/d1/d1": []byte("level5"),
-	}
-
-	if len(output) != len(expected) {
-		t.Fatalf("Expected length %d, got %d", len(expected), len(output))
-	}
-	for _, p := range output {
-		if !reflect.DeepEqual(p.Value, expected[p.Key]) {
-			t.Fatalf("Key : %s\nExpected %s\nGot %s", p.Key, expected[p.Key], p.Value)
-		}
-	}
-}
-
 func TestCollateKvPairsBase64(t *testing.T) {
 	config := &struct {
 		Base64Bytes []byte
@@ -1132,15 +1154,15 @@ func TestParseKvSourceBase64(t *testing.T) {
 		Run: func() error { return nil },
 	}
 	kv := &KvSource{
-		&Mock{
+		Store: NewLibkvStore(&Mock{
 			KVPairs: []*store.KVPair{
 				{
 					Key:   "test/base64bytes",
 					Value: []byte("VGVzdGluZyBhdXRvbWF0aWMgYmFzZTY0IGlmIGJ5dGUgYXJyYXk="),
 				},
 			},
-		},
-		"test",
+		}),
+		Prefix: "test",
 	}
 	if _, err := kv.Parse(rootCmd); err != nil {
 		t.Fatalf("Error %s", err)
@@ -1216,3 +1238,1859 @@ func TestDecodeHookCustomMarshaller(t *testing.T) {
 		t.Fatalf("Got %#v\nExpected %#v", output, data)
 	}
 }
+
+func TestSyncConfig(t *testing.T) {
+	//init
+	config := &struct {
+		Vfoo   string
+		Vmap   map[string]string
+		Vslice []int
+		Vptr   *BasicStruct
+	}{
+		Vfoo:   "toto",
+		Vmap:   map[string]string{"a": "foo"},
+		Vslice: []int{1},
+	}
+	kv := &KvSource{
+		Store: NewLibkvStore(&Mock{
+			KVPairs: []*store.KVPair{
+				{Key: "prefix/vfoo", Value: []byte("tata")},
+				{Key: "prefix/vmap/a", Value: []byte("bar")},
+				{Key: "prefix/vmap/b", Value: []byte("bar")},
+				{Key: "prefix/vslice/0", Value: []byte("0")},
+				{Key: "prefix/vslice/1", Value: []byte("1")},
+				{Key: "prefix/vptr/", Value: []byte("")},
+				{Key: "prefix/vptr/bar1", Value: []byte("bar1")},
+				{Key: "other/vfoo", Value: []byte("other")},
+			},
+		}),
+		Prefix: "prefix",
+	}
+
+	//test dry run
+	expectedStale := []string{"prefix/vmap/b", "prefix/vptr/", "prefix/vptr/bar1", "prefix/vslice/1"}
+	stale, err := kv.SyncConfig(config, true)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(stale, expectedStale) {
+		t.Fatalf("Got: %v\nExpected: %v", stale, expectedStale)
+	}
+	if len(kv.Store.(*LibkvStore).Store.(*Mock).KVPairs) != 8 {
+		t.Fatalf("Dry run should not modify the store, got %d keys", len(kv.Store.(*LibkvStore).Store.(*Mock).KVPairs))
+	}
+
+	//test
+	stale, err = kv.SyncConfig(config, false)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(stale, expectedStale) {
+		t.Fatalf("Got: %v\nExpected: %v", stale, expectedStale)
+	}
+
+	//check
+	expected := map[string][]byte{
+		"prefix/vfoo":     []byte("toto"),
+		"prefix/vmap/":    []byte(""),
+		"prefix/vmap/a":   []byte("foo"),
+		"prefix/vslice/":  []byte(""),
+		"prefix/vslice/0": []byte("1"),
+	}
+	result := map[string][]byte{}
+	if err := kv.ListRecursive("prefix", result); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Got: %s\nExpected: %s", result, expected)
+	}
+	if pair, _ := kv.Store.Get("other/vfoo"); pair == nil {
+		t.Fatalf("Keys outside of the prefix should not be deleted")
+	}
+}
+
+// lossyStore drops the keys containing "lost"
+type lossyStore struct {
+	*Mock
+}
+
+func (s *lossyStore) Put(key string, value []byte, opts *store.WriteOptions) error {
+	if strings.Contains(key, "lost") {
+		return nil
+	}
+	return s.Mock.Put(key, value, opts)
+}
+
+func TestPublishConfig(t *testing.T) {
+	type PublishStruct struct {
+		Vfoo string
+		Vptr *BasicStruct
+	}
+	mock := &Mock{
+		KVPairs: []*store.KVPair{
+			{Key: "prefix/vfoo", Value: []byte("unpublished")},
+		},
+	}
+	kv := &KvSource{
+		Store:  NewLibkvStore(mock),
+		Prefix: "prefix",
+	}
+
+	for i, vfoo := range []string{"v1", "v2", "v3"} {
+		//test
+		config := &PublishStruct{
+			Vfoo: vfoo,
+			Vptr: &BasicStruct{Bar1: vfoo},
+		}
+		if err := kv.PublishConfig(config); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		//check
+		loaded := &PublishStruct{}
+		if err := kv.LoadConfig(loaded); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(loaded, config) {
+			t.Fatalf("Got: %+v\nExpected: %+v", loaded, config)
+		}
+		if version, _, _ := kv.currentVersion(); version != i+1 {
+			t.Fatalf("Expected version %d, got %d", i+1, version)
+		}
+	}
+
+	//check old versions
+	for version, expected := range map[int]bool{1: false, 2: true, 3: true} {
+		pair, _ := kv.Store.Get(kv.versionPrefix(version) + "/vfoo")
+		if (pair != nil) != expected {
+			t.Fatalf("Version %d: expected to be kept %t", version, expected)
+		}
+	}
+	if pair, _ := kv.Store.Get("prefix/vfoo"); pair == nil || string(pair.Value) != "unpublished" {
+		t.Fatalf("Keys under prefix should not be modified, got %+v", pair)
+	}
+}
+
+func TestSyncConfigKeepsMetadata(t *testing.T) {
+	kv := &KvSource{Store: NewLibkvStore(&Mock{}), Prefix: "prefix", LockKey: "prefix/.lock"}
+	config := &struct{ Vfoo string }{"foo"}
+	// the lock key written by the store
+	for key, value := range map[string]string{"prefix/.lock": "held", "prefix/vbar": "bar"} {
+		if err := kv.Store.Put(key, []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	//test
+	stale, err := kv.SyncConfig(config, true)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check : the lock is not stale
+	expected := []string{"prefix/vbar"}
+	if !reflect.DeepEqual(stale, expected) {
+		t.Fatalf("Got: %v\nExpected: %v", stale, expected)
+	}
+}
+
+func TestSyncConfigOptimisticShouldFail(t *testing.T) {
+	kv := &KvSource{Store: NewLibkvStore(&Mock{}), Prefix: "prefix", Optimistic: true}
+	if err := kv.Store.Put("prefix/vbar", []byte("bar")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config := &struct{ Vfoo string }{"foo"}
+
+	//test
+	_, err := kv.SyncConfig(config, false)
+
+	//check : nothing is written nor deleted
+	if err == nil || err.Error() != "SyncConfig can not be used in Optimistic mode: stale keys can not be deleted atomically" {
+		t.Fatalf("Expected Optimistic mode error, got %v", err)
+	}
+	if _, err := kv.Store.Get("prefix/vbar"); err != nil {
+		t.Fatalf("Expected prefix/vbar to be kept, got %v", err)
+	}
+	if _, err := kv.Store.Get("prefix/vfoo"); err != ErrKeyNotFound {
+		t.Fatalf("Expected prefix/vfoo not to be written, got %v", err)
+	}
+	// a dry run writes nothing
+	stale, err := kv.SyncConfig(config, true)
+	if err != nil || !reflect.DeepEqual(stale, []string{"prefix/vbar"}) {
+		t.Fatalf("Expected [prefix/vbar] to be stale, got %v (%v)", stale, err)
+	}
+}
+
+// listHookKvStore calls onList before listing a key
+type listHookKvStore struct {
+	KvStore
+	onList func(key string)
+}
+
+func (s *listHookKvStore) List(prefix string) ([]*KvPair, error) {
+	s.onList(prefix)
+	return s.KvStore.List(prefix)
+}
+
+func TestLoadConfigPublishedWhileLoading(t *testing.T) {
+	type PublishedStruct struct {
+		X string
+	}
+	memStore := NewMemStore()
+	publisher := &KvSource{Store: memStore, Prefix: "prefix", KeepVersions: 1}
+	if err := publisher.PublishConfig(&PublishedStruct{X: "1"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// a version published (deleting the listed one) between reading the version and listing it
+	published := 1
+	publishes := 1
+	hook := &listHookKvStore{KvStore: memStore}
+	hook.onList = func(key string) {
+		if publishes > 0 && strings.HasPrefix(key, "prefix/.versions/") {
+			publishes--
+			published++
+			if err := publisher.PublishConfig(&PublishedStruct{X: strconv.Itoa(published)}); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+		}
+	}
+	kv := &KvSource{Store: hook, Prefix: "prefix"}
+	loaded := &PublishedStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if loaded.X != "2" {
+		t.Fatalf("Expected the new version to be loaded, got %+v", loaded)
+	}
+
+	// a version published while listing every time
+	publishes = kvLoadAttempts
+	loaded = &PublishedStruct{}
+	err := kv.LoadConfig(loaded)
+	if err == nil || err.Error() != "cannot load prefix: version 6 was replaced by version 7 while loading it, 5 times" {
+		t.Fatalf("Expected replaced version error, got %v (%+v)", err, loaded)
+	}
+}
+
+func TestStoreConfigPublishedShouldFail(t *testing.T) {
+	type PublishedStruct struct {
+		Vfoo string
+		Vptr *BasicStruct
+	}
+	kv := &KvSource{Store: NewLibkvStore(&Mock{}), Prefix: "prefix"}
+	config := &PublishedStruct{Vfoo: "foo", Vptr: &BasicStruct{Bar1: "bar1"}}
+	if err := kv.PublishConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test
+	changed := &PublishedStruct{Vfoo: "changed", Vptr: &BasicStruct{Bar1: "changed"}}
+	expectedErr := "version 1 is published under prefix, the config can only be changed by PublishConfig"
+	if err := kv.StoreConfig(changed); err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected published error, got %v", err)
+	}
+	if err := kv.StoreField(changed, "vptr/bar1"); err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected published error, got %v", err)
+	}
+	if _, err := kv.SyncConfig(changed, true); err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected published error, got %v", err)
+	}
+	if _, err := kv.Plan(changed); err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected published error, got %v", err)
+	}
+	if err := kv.KeepAlive(changed, time.Minute, nil); err == nil || err.Error() != expectedErr {
+		t.Fatalf("Expected published error, got %v", err)
+	}
+
+	//check
+	loaded := &PublishedStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got: %+v\nExpected: %+v", loaded, config)
+	}
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive("prefix/vfoo", pairs); err != nil || len(pairs) != 0 {
+		t.Fatalf("Expected nothing written under prefix, got %s (%v)", pairs, err)
+	}
+}
+
+func TestPublishConfigVerificationShouldFail(t *testing.T) {
+	kv := &KvSource{
+		Store:  NewLibkvStore(&lossyStore{&Mock{}}),
+		Prefix: "prefix",
+	}
+	if err := kv.PublishConfig(&struct{ Vfoo string }{"foo"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test
+	err := kv.PublishConfig(&struct{ Vfoo, Vlost string }{"bar", "lost"})
+	if err == nil || err.Error() != "verification failed on key prefix/.versions/2/vlost" {
+		t.Fatalf("Expected verification error, got %v", err)
+	}
+
+	//check
+	if version, _, _ := kv.currentVersion(); version != 1 {
+		t.Fatalf("Expected version 1, got %d", version)
+	}
+	if pair, _ := kv.Store.Get("prefix/.versions/2/vfoo"); pair != nil {
+		t.Fatalf("Failed version should be deleted, got %+v", pair)
+	}
+	loaded := &struct{ Vfoo string }{}
+	if err := kv.LoadConfig(loaded); err != nil || loaded.Vfoo != "foo" {
+		t.Fatalf("Expected previous config, got %+v (%v)", loaded, err)
+	}
+}
+
+func TestStoreConfigOptimistic(t *testing.T) {
+	type OptimisticStruct struct {
+		Vfoo string
+		Vbar string
+		Vmap map[string]string
+	}
+	mock := NewMemStore()
+	writer1 := &KvSource{Store: mock, Prefix: "prefix", Optimistic: true}
+	writer2 := &KvSource{Store: mock, Prefix: "prefix", Optimistic: true}
+	if err := writer1.StoreConfig(&OptimisticStruct{Vfoo: "foo", Vbar: "bar"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config1 := &OptimisticStruct{}
+	if err := writer1.LoadConfig(config1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config2 := &OptimisticStruct{}
+	if err := writer2.LoadConfig(config2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test
+	config2.Vbar = "bar2"
+	config2.Vmap = map[string]string{"key": "value2"}
+	if err := writer2.StoreConfig(config2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config1.Vfoo = "foo1"
+	config1.Vmap = map[string]string{"key": "value1"}
+	err := writer1.StoreConfig(config1)
+
+	//check
+	conflict, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("Expected a ConflictError, got %v", err)
+	}
+	expected := []string{"prefix/vbar", "prefix/vmap/key"}
+	if !reflect.DeepEqual(conflict.Keys, expected) {
+		t.Fatalf("Got contested keys %v\nExpected: %v", conflict.Keys, expected)
+	}
+	loaded := &OptimisticStruct{}
+	if err := writer1.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config2) {
+		t.Fatalf("Nothing should be written on conflict, got %+v\nExpected: %+v", loaded, config2)
+	}
+
+	// after a reload, the config can be stored again, many times
+	loaded.Vfoo = "foo1"
+	for i := 0; i < 2; i++ {
+		if err := writer1.StoreConfig(loaded); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+}
+
+func TestPublishConfigOptimistic(t *testing.T) {
+	mock := NewMemStore()
+	writer1 := &KvSource{Store: mock, Prefix: "prefix", Optimistic: true}
+	writer2 := &KvSource{Store: mock, Prefix: "prefix", Optimistic: true}
+	config := &struct{ Vfoo string }{}
+	if err := writer1.LoadConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := writer2.LoadConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test
+	if err := writer2.PublishConfig(&struct{ Vfoo string }{"foo2"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err := writer1.PublishConfig(&struct{ Vfoo string }{"foo1"})
+
+	//check
+	conflict, ok := err.(*ConflictError)
+	if !ok || !reflect.DeepEqual(conflict.Keys, []string{"prefix/.version"}) {
+		t.Fatalf("Expected a ConflictError on prefix/.version, got %v", err)
+	}
+	if err := writer1.LoadConfig(config); err != nil || config.Vfoo != "foo2" {
+		t.Fatalf("Expected published config, got %+v (%v)", config, err)
+	}
+	if err := writer1.PublishConfig(&struct{ Vfoo string }{"foo1"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := writer1.LoadConfig(config); err != nil || config.Vfoo != "foo1" {
+		t.Fatalf("Expected published config, got %+v (%v)", config, err)
+	}
+}
+
+func TestStoreConfigLock(t *testing.T) {
+	mock := NewMemStore()
+	kv := &KvSource{
+		Store:       mock,
+		Prefix:      "prefix",
+		LockKey:     "prefix/.lock",
+		LockTimeout: 10 * time.Millisecond,
+	}
+	config := &struct{ Vfoo string }{"foo"}
+
+	// another writer holds the lock
+	locker, err := mock.NewLock("prefix/.lock", 0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := locker.Lock(nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test
+	err = kv.StoreConfig(config)
+
+	//check
+	if err == nil || err.Error() != "timeout acquiring lock prefix/.lock after 10ms" {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if pair, _ := kv.Store.Get("prefix/vfoo"); pair != nil {
+		t.Fatalf("Nothing should be written without the lock, got %+v", pair)
+	}
+
+	// the lock is released by the other writer, then by each write
+	if err := locker.Unlock(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := kv.SyncConfig(config, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kv.PublishConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if pair, _ := kv.Store.Get("prefix/vfoo"); pair == nil || string(pair.Value) != "foo" {
+		t.Fatalf("Expected prefix/vfoo to be written, got %+v", pair)
+	}
+}
+
+func TestRevisionsAndRollback(t *testing.T) {
+	type RevisionStruct struct {
+		Vfoo string
+		Vbar string
+		Vptr *BasicStruct
+	}
+	kv := &KvSource{
+		Store:        NewMemStore(),
+		Prefix:       "prefix",
+		KeepVersions: 3,
+	}
+	configs := []*RevisionStruct{
+		{Vfoo: "foo1", Vbar: "bar"},
+		{Vfoo: "foo2", Vbar: "bar", Vptr: &BasicStruct{Bar1: "bar1"}},
+		{Vfoo: "foo3"},
+	}
+	for i, config := range configs {
+		kv.Author = "author" + strconv.Itoa(i+1)
+		if err := kv.PublishConfig(config); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	//test revisions
+	revisions, err := kv.Revisions()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("Expected 3 revisions, got %+v", revisions)
+	}
+	for i, revision := range revisions {
+		if revision.Version != i+1 || revision.Author != "author"+strconv.Itoa(i+1) || revision.Timestamp.IsZero() || revision.Current != (i == 2) {
+			t.Fatalf("Unexpected revision %d: %+v", i+1, revision)
+		}
+	}
+
+	//test diff
+	changes, err := kv.DiffRevisions(1, 2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var lines []string
+	for _, change := range changes {
+		lines = append(lines, change.String())
+	}
+	expected := []string{
+		`~ vfoo = "foo1" -> "foo2"`,
+		`+ vptr/ = ""`,
+		`+ vptr/bar1 = "bar1"`,
+		`+ vptr/bar2 = ""`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Got changes:\n%s\nExpected:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+
+	//test rollback
+	kv.Author = "rollbacker"
+	if err := kv.Rollback(2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded := &RevisionStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, configs[1]) {
+		t.Fatalf("Got: %+v\nExpected: %+v", loaded, configs[1])
+	}
+	revisions, err = kv.Revisions()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(revisions) != 3 || revisions[0].Version != 2 || revisions[2].Version != 4 || revisions[2].Author != "rollbacker" {
+		t.Fatalf("Unexpected revisions after rollback: %+v", revisions)
+	}
+	if pair, _ := kv.Store.Get("prefix/.history/1/author"); pair != nil {
+		t.Fatalf("History of deleted versions should be deleted, got %+v", pair)
+	}
+	if err := kv.Rollback(1); err == nil || err.Error() != "revision 1 not found" {
+		t.Fatalf("Expected revision not found, got %v", err)
+	}
+}
+
+func TestKvTags(t *testing.T) {
+	type TaggedEmbedded struct {
+		Vembedded string
+	}
+	type TaggedStruct struct {
+		TaggedEmbedded `kv:",squash"`
+		Vname          string            `kv:"Name"`
+		Vmapstructure  string            `mapstructure:"ms_name"`
+		Vboth          string            `mapstructure:"ms_both" kv:"kv_both"`
+		Vskipped       string            `kv:"-"`
+		Vomitted       int               `kv:",omitempty"`
+		Vmap           map[string]string `kv:"Map,omitempty"`
+		Vptr           *BasicStruct      `kv:"Ptr"`
+	}
+	kv := &KvSource{
+		Store:  NewLibkvStore(&Mock{}),
+		Prefix: "prefix",
+	}
+	config := &TaggedStruct{
+		TaggedEmbedded: TaggedEmbedded{Vembedded: "embedded"},
+		Vname:          "name",
+		Vmapstructure:  "mapstructure",
+		Vboth:          "both",
+		Vskipped:       "skipped",
+		Vmap:           map[string]string{"key": "value"},
+		Vptr:           &BasicStruct{Bar1: "bar1"},
+	}
+
+	//test
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive("prefix", pairs); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var keys []string
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expectedKeys := []string{
+		"prefix/Map/",
+		"prefix/Map/key",
+		"prefix/Name",
+		"prefix/Ptr/",
+		"prefix/Ptr/bar1",
+		"prefix/Ptr/bar2",
+		"prefix/kv_both",
+		"prefix/ms_name",
+		"prefix/vembedded",
+	}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Fatalf("Got keys %v\nExpected: %v", keys, expectedKeys)
+	}
+	loaded := &TaggedStruct{Vskipped: "unchanged"}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config.Vskipped = "unchanged"
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got: %+v\nExpected: %+v", loaded, config)
+	}
+}
+
+func TestKvTagsOtherCasing(t *testing.T) {
+	type CasingStruct struct {
+		Vname string `kv:"name"`
+		Vfoo  string
+	}
+	// written by another service
+	kv := &KvSource{
+		Store: NewLibkvStore(&Mock{
+			KVPairs: []*store.KVPair{
+				{Key: "prefix/NAME", Value: []byte("name")},
+				{Key: "prefix/VFoo", Value: []byte("foo")},
+			},
+		}),
+		Prefix: "prefix",
+	}
+
+	//test
+	loaded := &CasingStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	expected := &CasingStruct{Vname: "name", Vfoo: "foo"}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("Got: %+v\nExpected: %+v", loaded, expected)
+	}
+}
+
+type RoundTripChild struct {
+	Vname  string
+	Vcount int
+	Vtags  []string
+}
+
+type RoundTripStruct struct {
+	RoundTripChild `kv:",squash"`
+	Vstring        string
+	Vint8          int8
+	Vint64         int64
+	Vuint          uint
+	Vfloat32       float32
+	Vfloat64       float64
+	Vbool          bool
+	Vbytes         []byte
+	Vptr           *RoundTripChild
+	Vptrstring     *string
+	Vmap           map[string]string
+	Vmapint        map[int]float64
+	Vmapptr        map[string]*RoundTripChild
+	Vslice         []RoundTripChild
+	Vslices        [][]int
+	Vdata          interface{}
+	Vdatas         map[string]interface{}
+	Varray         [3]int
+	Vbytearray     [4]byte
+	Vptrarray      [2]*RoundTripChild
+	Vjson          *RoundTripChild    `kv:",json"`
+	Vjsonmap       map[string][]int   `kv:",json"`
+	Vjsonslice     []*RoundTripChild  `kv:",json"`
+	Vjsonarray     [2]*RoundTripChild `kv:",json"`
+}
+
+// Generate implements quick.Generator, with nil and empty values, and tricky strings
+func (RoundTripStruct) Generate(rand *rand.Rand, size int) reflect.Value {
+	str := func() string {
+		special := []string{"", "/", "a/b", "%", "%2F", "é", " ", "0"}
+		if rand.Intn(2) == 0 {
+			return special[rand.Intn(len(special))]
+		}
+		value, _ := quick.Value(reflect.TypeOf(""), rand)
+		return value.String()
+	}
+	key := func() string {
+		if k := str(); len(k) > 0 {
+			return k
+		}
+		return "k"
+	}
+	// nil, empty or filled
+	length := func() int { return rand.Intn(4) - 1 }
+	strs := func() []string {
+		n := length()
+		if n < 0 {
+			return nil
+		}
+		values := make([]string, n)
+		for i := range values {
+			values[i] = str()
+		}
+		return values
+	}
+	child := func() RoundTripChild {
+		return RoundTripChild{Vname: str(), Vcount: rand.Int(), Vtags: strs()}
+	}
+	var data func(depth int) interface{}
+	data = func(depth int) interface{} {
+		switch rand.Intn(6) {
+		case 0:
+			return nil
+		case 1:
+			return str()
+		case 2:
+			return rand.NormFloat64()
+		case 3:
+			return rand.Intn(2) == 0
+		case 4:
+			if depth > 0 {
+				return []interface{}{data(depth - 1), data(depth - 1)}
+			}
+		case 5:
+			if depth > 0 {
+				return map[string]interface{}{key(): data(depth - 1)}
+			}
+		}
+		return str()
+	}
+
+	value := RoundTripStruct{
+		RoundTripChild: child(),
+		Vstring:        str(),
+		Vint8:          int8(rand.Int()),
+		Vint64:         rand.Int63() - rand.Int63(),
+		Vuint:          uint(rand.Uint64()),
+		Vfloat32:       rand.Float32() * float32(rand.NormFloat64()),
+		Vfloat64:       rand.NormFloat64() * 1e10,
+		Vbool:          rand.Intn(2) == 0,
+		Vdata:          data(2),
+	}
+	if n := length(); n >= 0 {
+		value.Vbytes = make([]byte, n)
+		rand.Read(value.Vbytes)
+	}
+	for i := range value.Varray {
+		value.Varray[i] = rand.Int()
+	}
+	rand.Read(value.Vbytearray[:rand.Intn(len(value.Vbytearray)+1)])
+	for i := range value.Vptrarray {
+		if rand.Intn(2) == 0 {
+			c := child()
+			value.Vptrarray[i] = &c
+		}
+	}
+	if rand.Intn(2) == 0 {
+		c := child()
+		value.Vptr = &c
+	}
+	if rand.Intn(2) == 0 {
+		s := str()
+		value.Vptrstring = &s
+	}
+	if rand.Intn(2) == 0 {
+		c := child()
+		value.Vjson = &c
+	}
+	if n := length(); n >= 0 {
+		value.Vjsonmap = map[string][]int{}
+		value.Vjsonslice = make([]*RoundTripChild, n)
+		for i := 0; i < n; i++ {
+			var ints []int
+			if m := length(); m >= 0 {
+				ints = make([]int, m)
+				for j := range ints {
+					ints[j] = rand.Int()
+				}
+			}
+			value.Vjsonmap[key()] = ints
+			if rand.Intn(2) == 0 {
+				c := child()
+				value.Vjsonslice[i] = &c
+			}
+		}
+	}
+	if rand.Intn(2) == 0 {
+		c := child()
+		value.Vjsonarray[rand.Intn(len(value.Vjsonarray))] = &c
+	}
+	if n := length(); n >= 0 {
+		value.Vmap = map[string]string{}
+		value.Vmapint = map[int]float64{}
+		value.Vmapptr = map[string]*RoundTripChild{}
+		value.Vdatas = map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			c := child()
+			value.Vmap[key()] = str()
+			value.Vmapint[rand.Int()-rand.Int()] = rand.NormFloat64()
+			value.Vmapptr[key()] = &c
+			value.Vdatas[key()] = data(1)
+		}
+	}
+	if n := length(); n >= 0 {
+		value.Vslice = make([]RoundTripChild, n)
+		value.Vslices = make([][]int, n)
+		for i := 0; i < n; i++ {
+			value.Vslice[i] = child()
+			value.Vslices[i] = []int{}
+			for j := length(); j > 0; j-- {
+				value.Vslices[i] = append(value.Vslices[i], rand.Int())
+			}
+		}
+	}
+	return reflect.ValueOf(value)
+}
+
+func TestStoreLoadConfigRoundTrip(t *testing.T) {
+	roundTrip := func(config RoundTripStruct) bool {
+		kv := &KvSource{
+			Store:  NewMemStore(),
+			Prefix: "prefix",
+		}
+		if err := kv.StoreConfig(&config); err != nil {
+			t.Logf("Error storing %+v: %v", config, err)
+			return false
+		}
+		loaded := RoundTripStruct{}
+		if err := kv.LoadConfig(&loaded); err != nil {
+			t.Logf("Error loading %+v: %v", config, err)
+			return false
+		}
+		if !reflect.DeepEqual(loaded, config) {
+			t.Logf("Got: %#v\nExpected: %#v", loaded, config)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreConfigNilElementShouldFail(t *testing.T) {
+	kv := &KvSource{
+		Store:  NewLibkvStore(&Mock{}),
+		Prefix: "prefix",
+	}
+	config := &struct {
+		Vslice []*BasicStruct
+	}{
+		Vslice: []*BasicStruct{{}, nil},
+	}
+	err := kv.StoreConfig(config)
+	if err == nil || err.Error() != "nil element not supported: prefix/vslice/1" {
+		t.Fatalf("Expected nil element error, got %v", err)
+	}
+}
+
+func TestLoadConfigArray(t *testing.T) {
+	type ArrayStruct struct {
+		Vints  [3]int
+		Vbytes [2]byte
+	}
+	kv := &KvSource{
+		Store: NewLibkvStore(&Mock{
+			KVPairs: []*store.KVPair{
+				{Key: "prefix/vints/0", Value: []byte("1")},
+				{Key: "prefix/vints/2", Value: []byte("3")},
+				{Key: "prefix/vbytes", Value: []byte("AQ==")},
+			},
+		}),
+		Prefix: "prefix",
+	}
+
+	//test
+	loaded := &ArrayStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	expected := &ArrayStruct{Vints: [3]int{1, 0, 3}, Vbytes: [2]byte{1, 0}}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("Got: %+v\nExpected: %+v", loaded, expected)
+	}
+}
+
+func TestLoadConfigArrayOutOfBoundsShouldFail(t *testing.T) {
+	kv := &KvSource{
+		Store: NewLibkvStore(&Mock{
+			KVPairs: []*store.KVPair{
+				{Key: "prefix/vints/0", Value: []byte("1")},
+				{Key: "prefix/vints/3", Value: []byte("4")},
+			},
+		}),
+		Prefix: "prefix",
+	}
+	err := kv.LoadConfig(&struct{ Vints [3]int }{})
+	if err == nil || !strings.Contains(err.Error(), "index 3 out of bounds of array [3]int") {
+		t.Fatalf("Expected out of bounds error, got %v", err)
+	}
+}
+
+func TestKeyEscapers(t *testing.T) {
+	type EscapedStruct struct {
+		Vmap map[string]string
+	}
+	config := &EscapedStruct{
+		Vmap: map[string]string{
+			"example.com/path": "path",
+			"100%":             "percent",
+			"a b":              "space",
+			"42":               "digits",
+		},
+	}
+	testCases := []struct {
+		escaper      KeyEscaper
+		expectedKeys []string
+	}{
+		{
+			escaper:      nil,
+			expectedKeys: []string{"prefix/vmap/", "prefix/vmap/100%25", "prefix/vmap/42", "prefix/vmap/a b", "prefix/vmap/example.com%2Fpath"},
+		},
+		{
+			escaper:      URLKeyEscaper,
+			expectedKeys: []string{"prefix/vmap/", "prefix/vmap/100%25", "prefix/vmap/42", "prefix/vmap/a%20b", "prefix/vmap/example.com%2Fpath"},
+		},
+	}
+	for _, test := range testCases {
+		kv := &KvSource{
+			Store:      NewLibkvStore(&Mock{}),
+			Prefix:     "prefix",
+			KeyEscaper: test.escaper,
+		}
+		if err := kv.StoreConfig(config); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		var keys []string
+		for _, pair := range kv.Store.(*LibkvStore).Store.(*Mock).KVPairs {
+			keys = append(keys, pair.Key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, test.expectedKeys) {
+			t.Fatalf("Got keys %v\nExpected: %v", keys, test.expectedKeys)
+		}
+		loaded := &EscapedStruct{}
+		if err := kv.LoadConfig(loaded); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(loaded, config) {
+			t.Fatalf("Got: %+v\nExpected: %+v", loaded, config)
+		}
+	}
+}
+
+func TestRawKeyEscaper(t *testing.T) {
+	kv := &KvSource{
+		Store:      NewLibkvStore(&Mock{}),
+		Prefix:     "prefix",
+		KeyEscaper: RawKeyEscaper,
+	}
+	config := &struct{ Vmap map[string]string }{map[string]string{"a/b": "c"}}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if pair, _ := kv.Store.Get("prefix/vmap/a/b"); pair == nil || string(pair.Value) != "c" {
+		t.Fatalf("Expected prefix/vmap/a/b to be written, got %+v", pair)
+	}
+}
+
+// TextKey is a struct map key implementing encoding.TextMarshaler and encoding.TextUnmarshaler
+type TextKey struct {
+	Zone string
+	ID   int
+}
+
+func (k TextKey) MarshalText() ([]byte, error) {
+	return []byte(k.Zone + ":" + strconv.Itoa(k.ID)), nil
+}
+
+func (k *TextKey) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(string(text), ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid key %q", text)
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return err
+	}
+	k.Zone, k.ID = parts[0], id
+	return nil
+}
+
+func TestTextMarshalerMapKeys(t *testing.T) {
+	type TextKeyStruct struct {
+		Vmap    map[TextKey]string
+		Vstruct map[TextKey]*BasicStruct
+	}
+	kv := &KvSource{
+		Store:  NewLibkvStore(&Mock{}),
+		Prefix: "prefix",
+	}
+	config := &TextKeyStruct{
+		Vmap: map[TextKey]string{
+			{Zone: "eu/west", ID: 1}: "foo",
+			{Zone: "us", ID: 2}:      "bar",
+		},
+		Vstruct: map[TextKey]*BasicStruct{
+			{Zone: "eu", ID: 3}: {Bar1: "bar1"},
+		},
+	}
+
+	//test
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	for _, key := range []string{"prefix/vmap/eu%2Fwest:1", "prefix/vmap/us:2", "prefix/vstruct/eu:3/bar1"} {
+		if pair, _ := kv.Store.Get(key); pair == nil {
+			t.Fatalf("Expected key %s to be written", key)
+		}
+	}
+	loaded := &TextKeyStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got: %+v\nExpected: %+v", loaded, config)
+	}
+}
+
+func TestTextUnmarshalerMapKeysShouldFail(t *testing.T) {
+	kv := &KvSource{
+		Store: NewLibkvStore(&Mock{
+			KVPairs: []*store.KVPair{
+				{Key: "prefix/vmap/nocolon", Value: []byte("foo")},
+			},
+		}),
+		Prefix: "prefix",
+	}
+	err := kv.LoadConfig(&struct{ Vmap map[TextKey]string }{})
+	if err == nil || err.Error() != `error unmarshaling map key nocolon: invalid key "nocolon"` {
+		t.Fatalf("Expected unmarshaling error, got %v", err)
+	}
+}
+
+// latencyStore injects latency into List and Get, and counts the calls
+type latencyStore struct {
+	store.Store
+	latency time.Duration
+	// List returns every key under the prefix, like Consul
+	recursive bool
+	calls     int32
+	inFlight  int32
+	// maximum number of concurrent calls
+	maxInFlight int32
+}
+
+func (s *latencyStore) call() func() {
+	atomic.AddInt32(&s.calls, 1)
+	inFlight := atomic.AddInt32(&s.inFlight, 1)
+	for {
+		max := atomic.LoadInt32(&s.maxInFlight)
+		if inFlight <= max || atomic.CompareAndSwapInt32(&s.maxInFlight, max, inFlight) {
+			break
+		}
+	}
+	time.Sleep(s.latency)
+	return func() { atomic.AddInt32(&s.inFlight, -1) }
+}
+
+func (s *latencyStore) List(prefix string, options *store.ReadOptions) ([]*store.KVPair, error) {
+	defer s.call()()
+	if !s.recursive {
+		return s.Store.List(prefix, options)
+	}
+	var pairs []*store.KVPair
+	for _, pair := range s.Store.(*Mock).KVPairs {
+		if strings.HasPrefix(pair.Key, prefix+"/") {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs, nil
+}
+
+func (s *latencyStore) Get(key string, options *store.ReadOptions) (*store.KVPair, error) {
+	defer s.call()()
+	return s.Store.Get(key, options)
+}
+
+// LoadStruct is a config of len(Vmaps)*len(Vmaps[x]) keys
+type LoadStruct struct {
+	Vfoo  string
+	Vmaps map[string]map[string]string
+}
+
+func newLoadStruct(maps, keys int) *LoadStruct {
+	config := &LoadStruct{Vfoo: "foo", Vmaps: map[string]map[string]string{}}
+	for i := 0; i < maps; i++ {
+		m := map[string]string{}
+		for j := 0; j < keys; j++ {
+			m["key"+strconv.Itoa(j)] = strconv.Itoa(i * j)
+		}
+		config.Vmaps["map"+strconv.Itoa(i)] = m
+	}
+	return config
+}
+
+func TestLoadConfigSingleScan(t *testing.T) {
+	config := newLoadStruct(10, 10)
+	mock := &Mock{
+		// another prefix, which must not be loaded
+		KVPairs: []*store.KVPair{{Key: "prefix2/vfoo", Value: []byte("prefix2")}},
+	}
+	if err := (&KvSource{Store: NewLibkvStore(mock), Prefix: "prefix"}).StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, recursive := range []bool{true, false} {
+		latency := &latencyStore{Store: mock, latency: time.Millisecond, recursive: recursive}
+		kv := &KvSource{
+			Store:           &LibkvStore{Store: latency, Recursive: recursive},
+			Prefix:          "prefix",
+			ListConcurrency: 4,
+		}
+
+		//test
+		loaded := &LoadStruct{}
+		if err := kv.LoadConfig(loaded); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		//check
+		if !reflect.DeepEqual(loaded, config) {
+			t.Fatalf("Got: %+v\nExpected: %+v", loaded, config)
+		}
+		// Get of the version key, then List
+		if recursive && latency.calls != 2 {
+			t.Fatalf("Expected a single List, got %d calls", latency.calls)
+		}
+		if !recursive && (latency.maxInFlight < 2 || latency.maxInFlight > 4) {
+			t.Fatalf("Expected between 2 and 4 concurrent calls, got %d", latency.maxInFlight)
+		}
+	}
+}
+
+// countingMemStore counts the calls to List and Get of a MemStore
+type countingMemStore struct {
+	*MemStore
+	lists int32
+	gets  int32
+}
+
+func (s *countingMemStore) List(prefix string) ([]*KvPair, error) {
+	atomic.AddInt32(&s.lists, 1)
+	return s.MemStore.List(prefix)
+}
+
+func (s *countingMemStore) Get(key string) (*KvPair, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.MemStore.Get(key)
+}
+
+func TestLoadPathFlatKeysSingleList(t *testing.T) {
+	config := &struct{ Vmap map[string]string }{Vmap: map[string]string{}}
+	for i := 0; i < 200; i++ {
+		config.Vmap["key"+strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	s := &countingMemStore{MemStore: NewMemStore()}
+	kv := &KvSource{Store: s, Prefix: "prefix"}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	s.lists, s.gets = 0, 0
+
+	//test
+	loaded := &struct{ Vmap map[string]string }{}
+	if err := kv.LoadPath(loaded, "vmap"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got: %+v\nExpected: %+v", loaded, config)
+	}
+	// Get of the version key, then List of the 200 keys directly under prefix/vmap
+	if s.lists != 1 || s.gets != 1 {
+		t.Fatalf("Expected a single List and Get, got %d List and %d Get calls", s.lists, s.gets)
+	}
+}
+
+func TestLoadConfigConcurrentWalkShouldFail(t *testing.T) {
+	kv := &KvSource{
+		Store:  NewLibkvStore(&failingListStore{Mock: &Mock{}, failing: "prefix/vmaps/map3"}),
+		Prefix: "prefix",
+	}
+	if err := kv.StoreConfig(newLoadStruct(5, 5)); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err := kv.LoadConfig(&LoadStruct{})
+	if err == nil || err.Error() != "list failed on prefix/vmaps/map3" {
+		t.Fatalf("Expected list error, got %v", err)
+	}
+}
+
+// failingListStore fails listing the key failing
+type failingListStore struct {
+	*Mock
+	failing string
+}
+
+func (s *failingListStore) List(prefix string, options *store.ReadOptions) ([]*store.KVPair, error) {
+	if prefix == s.failing {
+		return nil, errors.New("list failed on " + prefix)
+	}
+	return s.Mock.List(prefix, options)
+}
+
+func benchmarkLoadConfig(b *testing.B, recursive bool, concurrency int) {
+	// 2000 keys
+	config := newLoadStruct(40, 50)
+	mock := &Mock{}
+	if err := (&KvSource{Store: NewLibkvStore(mock), Prefix: "prefix"}).StoreConfig(config); err != nil {
+		b.Fatalf("Error: %v", err)
+	}
+	kv := &KvSource{
+		Store:           &LibkvStore{Store: &latencyStore{Store: mock, latency: 50 * time.Microsecond, recursive: recursive}, Recursive: recursive},
+		Prefix:          "prefix",
+		ListConcurrency: concurrency,
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := kv.LoadConfig(&LoadStruct{}); err != nil {
+			b.Fatalf("Error: %v", err)
+		}
+	}
+}
+
+func BenchmarkLoadConfigWalk(b *testing.B) {
+	benchmarkLoadConfig(b, false, 1)
+}
+
+func BenchmarkLoadConfigConcurrentWalk(b *testing.B) {
+	benchmarkLoadConfig(b, false, 0)
+}
+
+func BenchmarkLoadConfigSingleScan(b *testing.B) {
+	benchmarkLoadConfig(b, true, 0)
+}
+
+func TestLoadConfigOverlays(t *testing.T) {
+	type OverlayStruct struct {
+		Vfoo   string
+		Vbar   string
+		Vmap   map[string]int
+		Vslice []string
+		Vptr   *BasicStruct
+	}
+	s := NewMemStore()
+	global := &KvSource{Store: s, Prefix: "global"}
+	if err := global.StoreConfig(&OverlayStruct{
+		Vfoo:   "global",
+		Vbar:   "global",
+		Vmap:   map[string]int{"a": 1, "b": 2},
+		Vslice: []string{"x", "y", "z"},
+	}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	region := &KvSource{Store: s, Prefix: "region/eu"}
+	if err := region.Store.Put("region/eu/vfoo", []byte("region")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := region.Store.Put("region/eu/vmap/b", []byte("3")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// the published version of an overlay is loaded
+	service := &KvSource{Store: s, Prefix: "service/api"}
+	if err := service.Store.Put("service/api/vbar", []byte("unpublished")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := service.PublishConfig(&struct {
+		Vslice []string
+		Vptr   *BasicStruct
+	}{[]string{"w"}, &BasicStruct{Bar1: "service"}}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test
+	kv := &KvSource{Store: s, Prefix: "global", Overlays: []string{"region/eu", "service/api"}}
+	config := &OverlayStruct{}
+	if err := kv.LoadConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	expected := &OverlayStruct{
+		Vfoo:   "region",
+		Vbar:   "global",
+		Vmap:   map[string]int{"a": 1, "b": 3},
+		Vslice: []string{"w", "y", "z"},
+		Vptr:   &BasicStruct{Bar1: "service"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("Got %+v\nExpected: %+v", config, expected)
+	}
+}
+
+func TestKvTagJSON(t *testing.T) {
+	type JSONStruct struct {
+		Vfoo    string
+		Vptr    *BasicStruct         `kv:",json"`
+		Vstruct BasicStruct          `kv:"struct,json"`
+		Vmap    map[string][]int     `kv:",json"`
+		Vslice  []BasicStruct        `kv:",json"`
+		Vnil    *BasicStruct         `kv:",json"`
+		Vtime   map[string]time.Time `kv:",json"`
+	}
+	kv := &KvSource{
+		Store:  NewMemStore(),
+		Prefix: "prefix",
+	}
+	config := &JSONStruct{
+		Vfoo:    "foo",
+		Vptr:    &BasicStruct{Bar1: "bar1"},
+		Vstruct: BasicStruct{Bar2: "bar2"},
+		Vmap:    map[string][]int{"a/b": {1, 2}},
+		Vslice:  []BasicStruct{{Bar1: "s1"}, {Bar2: "s2"}},
+		Vtime:   map[string]time.Time{"t": time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	//test
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive("prefix", pairs); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := map[string]string{
+		"prefix/vfoo":   "foo",
+		"prefix/vptr":   `{"Bar1":"bar1","Bar2":""}`,
+		"prefix/struct": `{"Bar1":"","Bar2":"bar2"}`,
+		"prefix/vmap":   `{"a/b":[1,2]}`,
+		"prefix/vslice": `[{"Bar1":"s1","Bar2":""},{"Bar1":"","Bar2":"s2"}]`,
+		"prefix/vtime":  `{"t":"2017-01-01T00:00:00Z"}`,
+	}
+	result := map[string]string{}
+	for key, value := range pairs {
+		result[key] = string(value)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Got %v\nExpected: %v", result, expected)
+	}
+	loaded := &JSONStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, config)
+	}
+
+	// a field stored before being tagged json is still loaded
+	if err := kv.Store.DeleteTree("prefix/vptr"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kv.Store.Put("prefix/vptr/bar1", []byte("exploded")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded = &JSONStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if loaded.Vptr == nil || loaded.Vptr.Bar1 != "exploded" {
+		t.Fatalf("Expected exploded Vptr, got %+v", loaded.Vptr)
+	}
+}
+
+func TestKvTagJSONInvalidShouldFail(t *testing.T) {
+	kv := &KvSource{
+		Store: NewLibkvStore(&Mock{
+			KVPairs: []*store.KVPair{
+				{Key: "prefix/vptr", Value: []byte("{invalid")},
+			},
+		}),
+		Prefix: "prefix",
+	}
+	config := &struct {
+		Vptr *BasicStruct `kv:",json"`
+	}{}
+	err := kv.LoadConfig(config)
+	if err == nil || !strings.HasPrefix(err.Error(), "error decoding JSON of field Vptr: ") {
+		t.Fatalf("Expected JSON error, got %v", err)
+	}
+}
+
+func TestSecretFields(t *testing.T) {
+	type SecretStruct struct {
+		User     string
+		Password string            `secret:"true"`
+		Tokens   map[string]string `kv:"tokens" secret:"true"`
+		Database *struct {
+			Host     string
+			Password string `secret:"true"`
+		} `secret:"true"`
+		Empty string `secret:"true"`
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	os.Setenv("STAERT_TEST_SECRET_KEY", base64.StdEncoding.EncodeToString(key))
+	defer os.Unsetenv("STAERT_TEST_SECRET_KEY")
+	secretCipher, err := AESGCMCipherFromEnv("STAERT_TEST_SECRET_KEY")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kv := &KvSource{
+		Store:        NewMemStore(),
+		Prefix:       "prefix",
+		SecretCipher: secretCipher,
+	}
+	config := &SecretStruct{
+		User:     "user",
+		Password: "password",
+		Tokens:   map[string]string{"api": "token"},
+	}
+	config.Database = &struct {
+		Host     string
+		Password string `secret:"true"`
+	}{"host", "dbpassword"}
+
+	//test
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive("prefix", pairs); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for key, value := range pairs {
+		switch {
+		case key == "prefix/user":
+			if string(value) != "user" {
+				t.Fatalf("Expected %s in plaintext, got %q", key, value)
+			}
+		case strings.HasSuffix(key, "/"):
+			if len(value) != 0 {
+				t.Fatalf("Expected directory key %s, got %q", key, value)
+			}
+		case !strings.HasPrefix(string(value), "aesgcm:"):
+			t.Fatalf("Expected %s to be encrypted, got %q", key, value)
+		}
+	}
+	if _, ok := pairs["prefix/tokens/api"]; !ok {
+		t.Fatalf("Expected map keys in plaintext, got %v", pairs)
+	}
+	loaded := &SecretStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, config)
+	}
+
+	// from a key file
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if kv.SecretCipher, err = AESGCMCipherFromFile(keyFile); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded = &SecretStruct{}
+	if err := kv.LoadConfig(loaded); err != nil || loaded.Password != "password" {
+		t.Fatalf("Expected decrypted password, got %q (%v)", loaded.Password, err)
+	}
+
+	// from a published version
+	if err := kv.PublishConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded = &SecretStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, config)
+	}
+}
+
+func TestSecretFieldsShouldFail(t *testing.T) {
+	type SecretStruct struct {
+		Password string `secret:"true"`
+	}
+	mock := NewMemStore()
+	kv := &KvSource{Store: mock, Prefix: "prefix"}
+	err := kv.StoreConfig(&SecretStruct{"password"})
+	if err == nil || err.Error() != "secret field prefix/password requires a SecretCipher" {
+		t.Fatalf("Expected missing SecretCipher error, got %v", err)
+	}
+
+	// not encrypted
+	if err := mock.Put("prefix/password", []byte("password")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kv.SecretCipher, _ = NewAESGCMCipher([]byte("0123456789abcdef"))
+	err = kv.LoadConfig(&SecretStruct{})
+	if err == nil || err.Error() != "error decrypting field Password: value not encrypted" {
+		t.Fatalf("Expected decryption error, got %v", err)
+	}
+
+	// another key
+	if err := kv.StoreConfig(&SecretStruct{"password"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kv.SecretCipher, _ = NewAESGCMCipher([]byte("fedcba9876543210"))
+	if err := kv.LoadConfig(&SecretStruct{}); err == nil {
+		t.Fatal("Expected decryption error with another key")
+	}
+
+	// moved to another key
+	type SecretsStruct struct {
+		Password string `secret:"true"`
+		Token    string `secret:"true"`
+	}
+	if err := kv.StoreConfig(&SecretsStruct{"password", "token"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	password, _ := mock.Get("prefix/password")
+	token, _ := mock.Get("prefix/token")
+	mock.Put("prefix/password", token.Value)
+	mock.Put("prefix/token", password.Value)
+	if err := kv.LoadConfig(&SecretsStruct{}); err == nil {
+		t.Fatal("Expected decryption error with a value moved to another key")
+	}
+
+	if _, err := NewAESGCMCipher([]byte("short")); err == nil {
+		t.Fatal("Expected invalid key error")
+	}
+	if _, err := AESGCMCipherFromEnv("STAERT_TEST_UNSET_SECRET_KEY"); err == nil {
+		t.Fatal("Expected unset environment variable error")
+	}
+}
+
+func TestStoreConfigTTL(t *testing.T) {
+	type TTLStruct struct {
+		Vfoo     string
+		Vruntime map[string]string `kv:",ttl=300ms"`
+	}
+	kv := &KvSource{Store: NewMemStore(), Prefix: "prefix"}
+	config := &TTLStruct{Vfoo: "foo", Vruntime: map[string]string{"instance": "1"}}
+	exists := func(key string) bool {
+		_, err := kv.Store.Get(key)
+		return err == nil
+	}
+	// expired polls until none of keys exists, for a few seconds
+	expired := func(keys ...string) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			found := false
+			for _, key := range keys {
+				found = found || exists(key)
+			}
+			if !found {
+				return true
+			}
+		}
+		return false
+	}
+
+	// a field tagged with a ttl
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !exists("prefix/vruntime/instance") {
+		t.Fatal("Expected prefix/vruntime/instance to be stored")
+	}
+	if !expired("prefix/vruntime/instance", "prefix/vruntime/") || !exists("prefix/vfoo") {
+		t.Fatal("Expected prefix/vruntime to expire, and prefix/vfoo to be kept")
+	}
+
+	// the whole config
+	if err := kv.StoreConfigTTL(config, 300*time.Millisecond); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !expired("prefix/vfoo") {
+		t.Fatal("Expected prefix/vfoo to expire")
+	}
+
+	// kept alive
+	stopCh := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- kv.KeepAlive(config, 300*time.Millisecond, stopCh)
+	}()
+	time.Sleep(time.Second)
+	if !exists("prefix/vfoo") || !exists("prefix/vruntime/instance") {
+		t.Fatal("Expected keys to be kept alive")
+	}
+	close(stopCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !expired("prefix/vfoo") {
+		t.Fatal("Expected prefix/vfoo to expire once not kept alive")
+	}
+}
+
+func TestStoreConfigTTLShouldFail(t *testing.T) {
+	config := &struct {
+		Vfoo string `kv:",ttl=forever"`
+	}{"foo"}
+	kv := &KvSource{Store: NewMemStore(), Prefix: "prefix"}
+	err := kv.StoreConfig(config)
+	if err == nil || err.Error() != `invalid ttl "forever" of field prefix/vfoo` {
+		t.Fatalf("Expected invalid ttl error, got %v", err)
+	}
+
+	kv.Optimistic = true
+	err = kv.StoreConfigTTL(&struct{ Vfoo string }{"foo"}, time.Minute)
+	if err == nil || err.Error() != "keys with a TTL can not be stored in Optimistic mode" {
+		t.Fatalf("Expected Optimistic mode error, got %v", err)
+	}
+
+	kv = &KvSource{Store: &mapKvStore{NewMemStore()}, Prefix: "prefix"}
+	err = kv.StoreConfigTTL(&struct{ Vfoo string }{"foo"}, time.Minute)
+	if err == nil || err.Error() != "cannot store prefix/vfoo with a TTL: TTLs not supported by the store" {
+		t.Fatalf("Expected unsupported TTL error, got %v", err)
+	}
+
+	// a store which can not expire keys
+	kv = &KvSource{Store: newTestFileStore(t), Prefix: "prefix"}
+	err = kv.StoreConfig(&struct {
+		Vbar string
+		Vfoo string `kv:",ttl=1m"`
+	}{"bar", "foo"})
+	if err == nil || err.Error() != "cannot store prefix/vfoo with a TTL: TTLs not supported by the store" {
+		t.Fatalf("Expected unsupported TTL error, got %v", err)
+	}
+	if _, err := kv.Store.Get("prefix/vbar"); err != ErrKeyNotFound {
+		t.Fatalf("Expected nothing stored, got %v", err)
+	}
+	kv = &KvSource{Store: NewLibkvStore(&Mock{}), Prefix: "prefix"}
+	if err := kv.StoreConfigTTL(&struct{ Vfoo string }{"foo"}, time.Minute); err == nil || err.Error() != "cannot store prefix/vfoo with a TTL: TTLs not supported by the store" {
+		t.Fatalf("Expected unsupported TTL error, got %v", err)
+	}
+	if err := NewLibkvStore(&Mock{}).PutTTL("prefix/vfoo", []byte("foo"), time.Minute); err != ErrTTLNotSupported {
+		t.Fatalf("Expected ErrTTLNotSupported, got %v", err)
+	}
+	// a libkv store declared as expiring keys
+	kv = &KvSource{Store: &LibkvStore{Store: &Mock{}, TTL: true}, Prefix: "prefix"}
+	if err := kv.StoreConfigTTL(&struct{ Vfoo string }{"foo"}, time.Minute); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+}
+
+func TestLoadPathStoreField(t *testing.T) {
+	type PathStruct struct {
+		Vfoo string
+		Vptr *BasicStruct
+		Vmap map[string]int
+	}
+	kv := &KvSource{Store: NewMemStore(), Prefix: "prefix"}
+	config := &PathStruct{Vfoo: "foo", Vptr: &BasicStruct{Bar1: "bar1", Bar2: "bar2"}, Vmap: map[string]int{"a": 1}}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// only the field is written
+	config.Vfoo = "changed"
+	config.Vptr.Bar1 = "new1"
+	if err := kv.StoreField(config, "vptr/bar1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	pairs := map[string][]byte{}
+	if err := kv.ListRecursive("prefix", pairs); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(pairs["prefix/vptr/bar1"]) != "new1" || string(pairs["prefix/vfoo"]) != "foo" {
+		t.Fatalf("Expected only prefix/vptr/bar1 to be stored, got %s", pairs)
+	}
+
+	// only the subtree is loaded
+	loaded := &PathStruct{Vfoo: "kept", Vptr: &BasicStruct{Bar2: "kept"}}
+	if err := kv.LoadPath(loaded, "vptr/bar1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := &PathStruct{Vfoo: "kept", Vptr: &BasicStruct{Bar1: "new1", Bar2: "kept"}}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, expected)
+	}
+	if err := kv.LoadPath(loaded, "/vmap/"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected.Vmap = map[string]int{"a": 1}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, expected)
+	}
+	// a missing path fails, loading nothing
+	if err := kv.LoadPath(loaded, "vbar"); err == nil || err.Error() != "no key at path vbar" {
+		t.Fatalf("Expected missing path error, got %v", err)
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, expected)
+	}
+
+	// the keys loaded by LoadPath are checked in Optimistic mode
+	kv.Optimistic = true
+	loaded.Vptr.Bar1 = "optimistic"
+	if err := kv.StoreField(loaded, "vptr/bar1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kv.Store.Put("prefix/vptr/bar1", []byte("other")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kv.StoreField(loaded, "vptr"); err == nil {
+		t.Fatal("Expected a ConflictError")
+	}
+}
+
+func TestLoadPathReplacesValue(t *testing.T) {
+	type Inner struct {
+		M map[string]int
+	}
+	type ShrunkStruct struct {
+		S    []string
+		P    *Inner
+		Vmap map[string]BasicStruct
+	}
+	kv := &KvSource{Store: NewMemStore(), Prefix: "prefix"}
+	config := &ShrunkStruct{
+		S:    []string{"x", "y", "z"},
+		P:    &Inner{M: map[string]int{"a": 1, "b": 2}},
+		Vmap: map[string]BasicStruct{"a": {Bar1: "bar1", Bar2: "bar2"}},
+	}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded := &ShrunkStruct{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	shrunk := &ShrunkStruct{S: []string{"x"}, P: &Inner{M: map[string]int{"a": 1}}, Vmap: config.Vmap}
+	if _, err := kv.SyncConfig(shrunk, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//test : the deleted elements and entries are not kept
+	if err := kv.LoadPath(loaded, "s"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kv.LoadPath(loaded, "p/m"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, shrunk) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, shrunk)
+	}
+
+	// a path under a map entry loads the whole entry
+	loaded.Vmap["a"] = BasicStruct{Bar1: "changed", Bar2: "changed"}
+	if err := kv.LoadPath(loaded, "vmap/a/bar1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Vmap, config.Vmap) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded.Vmap, config.Vmap)
+	}
+}
+
+func TestLoadPathStoreFieldShouldFail(t *testing.T) {
+	kv := &KvSource{Store: NewMemStore(), Prefix: "prefix"}
+	config := &struct{ Vptr *BasicStruct }{}
+	if err := kv.StoreField(config, "vptr/bar1"); err == nil || err.Error() != "no key at path vptr/bar1" {
+		t.Fatalf("Expected missing path error, got %v", err)
+	}
+	if err := kv.StoreField(config, "/"); err == nil || err.Error() != "empty path" {
+		t.Fatalf("Expected empty path error, got %v", err)
+	}
+	if err := kv.LoadPath(config, ""); err == nil || err.Error() != "empty path" {
+		t.Fatalf("Expected empty path error, got %v", err)
+	}
+	if err := kv.LoadPath(config, "vptr"); err == nil || err.Error() != "no key at path vptr" {
+		t.Fatalf("Expected missing path error, got %v", err)
+	}
+
+	// a path under an element of a slice
+	type SliceStruct struct {
+		Vslice   []string
+		Vstructs []BasicStruct
+	}
+	stored := &SliceStruct{Vslice: []string{"a", "b", "c"}, Vstructs: []BasicStruct{{Bar1: "bar1"}}}
+	if err := kv.StoreConfig(stored); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded := &SliceStruct{Vslice: []string{"x", "y", "z"}}
+	if err := kv.LoadPath(loaded, "vslice/2"); err == nil || err.Error() != "cannot load path vslice/2 under an element of the slice vslice: load vslice" {
+		t.Fatalf("Expected slice element error, got %v", err)
+	}
+	if err := kv.LoadPath(loaded, "vstructs/0/bar1"); err == nil || err.Error() != "cannot load path vstructs/0/bar1 under an element of the slice vstructs: load vstructs" {
+		t.Fatalf("Expected slice element error, got %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Vslice, []string{"x", "y", "z"}) {
+		t.Fatalf("Expected the slice to be unchanged, got %v", loaded.Vslice)
+	}
+	if err := kv.LoadPath(loaded, "vslice"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Vslice, stored.Vslice) {
+		t.Fatalf("Got %v\nExpected: %v", loaded.Vslice, stored.Vslice)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	type PlanStruct struct {
+		Vfoo      string
+		Vmap      map[string]string
+		Vptr      *BasicStruct
+		Vpassword string `secret:"true"`
+	}
+	kv := &KvSource{Store: NewMemStore(), Prefix: "prefix", LockKey: "prefix/.lock"}
+	kv.SecretCipher, _ = NewAESGCMCipher([]byte("0123456789abcdef"))
+	config := &PlanStruct{
+		Vfoo:      "foo",
+		Vmap:      map[string]string{"a": "1", "b": "2"},
+		Vptr:      &BasicStruct{Bar1: "bar1"},
+		Vpassword: "secret",
+	}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	plan, err := kv.Plan(config)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(plan) != 0 || plan.String() != "No changes.\n" {
+		t.Fatalf("Expected no changes, got %v", plan)
+	}
+
+	//test
+	config.Vfoo = "new"
+	config.Vmap = map[string]string{"a": "1", "c": "3"}
+	config.Vptr = nil
+	plan, err = kv.Plan(config)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//check
+	expected := `~ prefix/vfoo = "foo" -> "new"
++ prefix/vmap/c = "3"
+- prefix/vmap/b = "2"
+- prefix/vptr/ = ""
+- prefix/vptr/bar1 = "bar1"
+- prefix/vptr/bar2 = ""
+Plan: 1 to create, 1 to update, 4 to delete.
+`
+	if plan.String() != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", plan, expected)
+	}
+	// nothing is written
+	pair, err := kv.Store.Get("prefix/vfoo")
+	if err != nil || string(pair.Value) != "foo" {
+		t.Fatalf("Expected prefix/vfoo to be unchanged, got %+v (%v)", pair, err)
+	}
+	// SyncConfig makes the planned changes
+	if _, err := kv.SyncConfig(config, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	plan, err = kv.Plan(config)
+	if err != nil || len(plan) != 0 {
+		t.Fatalf("Expected no changes, got %v (%v)", plan, err)
+	}
+}
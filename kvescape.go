@@ -0,0 +1,70 @@
+package staert
+
+import (
+	"net/url"
+	"strings"
+)
+
+// KeyEscaper escapes map keys, so that each one is a single KV key level, and unescapes them
+// Unescape(Escape(key)) must return key.
+type KeyEscaper interface {
+	Escape(key string) string
+	Unescape(key string) string
+}
+
+var (
+	// PercentKeyEscaper escapes / as %2F and % as %25 (the default)
+	PercentKeyEscaper KeyEscaper = replacerEscaper{
+		escaper:   strings.NewReplacer("%", "%25", "/", "%2F"),
+		unescaper: strings.NewReplacer("%2F", "/", "%25", "%"),
+	}
+	// URLKeyEscaper escapes map keys like URL path segments (url.PathEscape)
+	// Keys which are not valid escaped path segments are unescaped as is.
+	URLKeyEscaper KeyEscaper = urlEscaper{}
+	// RawKeyEscaper does not escape map keys : a / in a map key creates KV directories, which can not be loaded back
+	RawKeyEscaper KeyEscaper = rawEscaper{}
+)
+
+type replacerEscaper struct {
+	escaper, unescaper *strings.Replacer
+}
+
+func (e replacerEscaper) Escape(key string) string {
+	return e.escaper.Replace(key)
+}
+
+func (e replacerEscaper) Unescape(key string) string {
+	return e.unescaper.Replace(key)
+}
+
+type urlEscaper struct{}
+
+func (urlEscaper) Escape(key string) string {
+	return url.PathEscape(key)
+}
+
+func (urlEscaper) Unescape(key string) string {
+	unescaped, err := url.PathUnescape(key)
+	if err != nil {
+		return key
+	}
+	return unescaped
+}
+
+type rawEscaper struct{}
+
+func (rawEscaper) Escape(key string) string {
+	return key
+}
+
+func (rawEscaper) Unescape(key string) string {
+	return key
+}
+
+// keyEscaper returns the KeyEscaper of the map keys
+func (kv *KvSource) keyEscaper() KeyEscaper {
+	if kv.KeyEscaper == nil {
+		return PercentKeyEscaper
+	}
+	return kv.KeyEscaper
+}
@@ -0,0 +1,143 @@
+package staert
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SecretCipher encrypts the values of the fields tagged `secret:"true"` before they are stored into the KV Store,
+// and decrypts them when they are loaded
+// key is the KV key of the value relative to the config (like "database/password"): a value must be bound to it,
+// so that it can not be moved to another key.
+type SecretCipher interface {
+	Encrypt(key string, plaintext []byte) (string, error)
+	Decrypt(key string, ciphertext string) ([]byte, error)
+}
+
+// aesGCMPrefix prefixes the values encrypted by the AES-GCM SecretCipher
+const aesGCMPrefix = "aesgcm:"
+
+type aesGCMCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCipher creates a SecretCipher using AES-GCM with key (16, 24 or 32 bytes, for AES-128, AES-192 or AES-256)
+// Values are stored as "aesgcm:" followed by the base64 encoding of a random nonce and the value sealed with its KV key as additional data.
+func NewAESGCMCipher(key []byte) (SecretCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMCipher{aead: aead}, nil
+}
+
+// AESGCMCipherFromFile creates an AES-GCM SecretCipher with the key read from the file at path, encoded in base64
+func AESGCMCipherFromFile(path string) (SecretCipher, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newAESGCMCipherBase64(string(encoded), path)
+}
+
+// AESGCMCipherFromEnv creates an AES-GCM SecretCipher with the key read from the environment variable name, encoded in base64
+func AESGCMCipherFromEnv(name string) (SecretCipher, error) {
+	encoded, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+	return newAESGCMCipherBase64(encoded, "$"+name)
+}
+
+func newAESGCMCipherBase64(encoded string, source string) (SecretCipher, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", source, err)
+	}
+	secretCipher, err := NewAESGCMCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", source, err)
+	}
+	return secretCipher, nil
+}
+
+func (c *aesGCMCipher) Encrypt(key string, plaintext []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, []byte(key))
+	return aesGCMPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *aesGCMCipher) Decrypt(key string, ciphertext string) ([]byte, error) {
+	if !strings.HasPrefix(ciphertext, aesGCMPrefix) {
+		return nil, errors.New("value not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, aesGCMPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	nonce, sealed := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, sealed, []byte(key))
+}
+
+// encryptKvMap puts into kv the values of secret encrypted with secretCipher, except the directory keys
+// The values are bound to their key relative to root, the key of the config.
+func encryptKvMap(secret map[string]string, kv map[string]string, secretCipher SecretCipher, root string) error {
+	for key, value := range secret {
+		if strings.HasSuffix(key, "/") {
+			kv[key] = value
+			continue
+		}
+		relative := strings.TrimPrefix(strings.Trim(key, "/"), strings.Trim(root, "/")+"/")
+		encrypted, err := secretCipher.Encrypt(relative, []byte(value))
+		if err != nil {
+			return fmt.Errorf("error encrypting key %s: %v", key, err)
+		}
+		kv[key] = encrypted
+	}
+	return nil
+}
+
+// decryptKvData returns data (generated by generateMapstructure, at the KV key path) with its values decrypted with secretCipher
+// Empty values are directory keys, they are not decrypted.
+func decryptKvData(data interface{}, secretCipher SecretCipher, path string) (interface{}, error) {
+	switch value := data.(type) {
+	case string:
+		if value == "" {
+			return value, nil
+		}
+		decrypted, err := secretCipher.Decrypt(path, value)
+		if err != nil {
+			return nil, err
+		}
+		return string(decrypted), nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			decrypted, err := decryptKvData(child, secretCipher, kvPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			out[key] = decrypted
+		}
+		return out, nil
+	}
+	return data, nil
+}
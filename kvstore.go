@@ -0,0 +1,250 @@
+package staert
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+var (
+	// ErrKeyNotFound is returned by a KvStore when a key does not exist
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrKeyModified is returned by KvStore.AtomicPut when the key was modified since the previous pair was read
+	ErrKeyModified = errors.New("key modified")
+	// ErrKeyExists is returned by KvStore.AtomicPut when the key exists, but no previous pair was given
+	ErrKeyExists = errors.New("key exists")
+	// ErrTTLNotSupported is returned by LibkvStore.PutTTL when the libkv store can not expire keys
+	ErrTTLNotSupported = errors.New("TTLs not supported by the store")
+)
+
+// libkvTTLBackends are the libkv backends expiring the keys written with WriteOptions.TTL
+var libkvTTLBackends = map[store.Backend]bool{
+	store.CONSUL: true,
+	store.ETCD:   true,
+}
+
+// libkvRecursiveBackends are the libkv backends listing every key under the prefix at once
+var libkvRecursiveBackends = map[store.Backend]bool{
+	store.CONSUL: true,
+	store.BOLTDB: true,
+}
+
+// KvPair is a key and its value in a KvStore
+type KvPair struct {
+	Key       string
+	Value     []byte
+	LastIndex uint64 // changed by every write of the key
+}
+
+// KvStore is the KV Store used by KvSource
+// Keys are separated by "/", and a key ending with "/" is a directory.
+// NewLibkvStore adapts a libkv store.Store (like Consul or etcd) to a KvStore. MemStore and FileStore are KvStores.
+// A KvStore also implementing ListsRecursively() bool (like LibkvStore) lists every key under the prefix at once if it returns true,
+// and the tree is loaded with a single List, instead of a List of every directory.
+type KvStore interface {
+	// Get returns the pair of key, or ErrKeyNotFound
+	Get(key string) (*KvPair, error)
+	// List returns the pairs under prefix : at least its direct children, maybe every key under it.
+	// It returns ErrKeyNotFound if there is no key under prefix.
+	List(prefix string) ([]*KvPair, error)
+	// Put writes value at key
+	Put(key string, value []byte) error
+	// Delete deletes key, or returns ErrKeyNotFound
+	Delete(key string) error
+	// DeleteTree deletes prefix and every key under it
+	DeleteTree(prefix string) error
+	// AtomicPut writes value at key if it was not modified since previous was read (compare-and-swap).
+	// If previous is nil, key must not exist (ErrKeyExists), otherwise it fails with ErrKeyModified or ErrKeyNotFound.
+	AtomicPut(key string, value []byte, previous *KvPair) (*KvPair, error)
+	// WatchTree sends the pairs under prefix, then the new pairs after every change, until stopCh is closed
+	WatchTree(prefix string, stopCh <-chan struct{}) (<-chan []*KvPair, error)
+}
+
+// KvTTLStore is implemented by the KvStores supporting keys expiring after a TTL, which are required to store keys with a TTL
+// A KvStore also implementing SupportsTTL() bool (like LibkvStore) supports them only if it returns true.
+type KvTTLStore interface {
+	// PutTTL writes value at key, expiring after ttl
+	PutTTL(key string, value []byte, ttl time.Duration) error
+}
+
+// KvLocker is implemented by the KvStores providing distributed locks, which are required by KvSource.LockKey
+type KvLocker interface {
+	// NewLock creates a lock for key, expiring after ttl unless it is renewed while it is held (store default if 0)
+	NewLock(key string, ttl time.Duration) (KvLock, error)
+}
+
+// KvLock is a distributed lock
+type KvLock interface {
+	// Lock waits until the lock is acquired, or stopCh is closed (then it returns a nil channel).
+	// The returned channel is closed if the lock is lost.
+	Lock(stopCh chan struct{}) (<-chan struct{}, error)
+	// Unlock releases the lock, and stops renewing it
+	Unlock() error
+}
+
+// LibkvStore adapts a libkv store.Store to a KvStore, a KvTTLStore and a KvLocker
+type LibkvStore struct {
+	Store store.Store
+	// TTL is true if the libkv store expires the keys written with a TTL (set by NewKvSource for Consul and etcd)
+	TTL bool
+	// Recursive is true if List returns every key under the prefix (set by NewKvSource for Consul and BoltDB)
+	Recursive bool
+}
+
+// NewLibkvStore creates a KvStore using a libkv store.Store, without TTLs
+func NewLibkvStore(s store.Store) *LibkvStore {
+	return &LibkvStore{Store: s}
+}
+
+// fromLibkvError converts the errors of libkv to the errors of KvStore
+func fromLibkvError(err error) error {
+	switch err {
+	case store.ErrKeyNotFound:
+		return ErrKeyNotFound
+	case store.ErrKeyModified:
+		return ErrKeyModified
+	case store.ErrKeyExists:
+		return ErrKeyExists
+	}
+	return err
+}
+
+func fromLibkvPair(pair *store.KVPair) *KvPair {
+	return &KvPair{Key: pair.Key, Value: pair.Value, LastIndex: pair.LastIndex}
+}
+
+func fromLibkvPairs(pairs []*store.KVPair) []*KvPair {
+	kvPairs := make([]*KvPair, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair != nil {
+			kvPairs = append(kvPairs, fromLibkvPair(pair))
+		}
+	}
+	return kvPairs
+}
+
+// Get returns the pair of key, or ErrKeyNotFound
+func (s *LibkvStore) Get(key string) (*KvPair, error) {
+	pair, err := s.Store.Get(key, nil)
+	if err != nil {
+		return nil, fromLibkvError(err)
+	}
+	if pair == nil {
+		return nil, ErrKeyNotFound
+	}
+	return fromLibkvPair(pair), nil
+}
+
+// List returns the pairs under prefix, or ErrKeyNotFound
+func (s *LibkvStore) List(prefix string) ([]*KvPair, error) {
+	pairs, err := s.Store.List(prefix, nil)
+	if err != nil {
+		return nil, fromLibkvError(err)
+	}
+	return fromLibkvPairs(pairs), nil
+}
+
+// ListsRecursively returns Recursive
+func (s *LibkvStore) ListsRecursively() bool {
+	return s.Recursive
+}
+
+// Put writes value at key, a key ending with "/" is written as a directory
+func (s *LibkvStore) Put(key string, value []byte) error {
+	return s.PutTTL(key, value, 0)
+}
+
+// PutTTL writes value at key, expiring after ttl (if not 0)
+// It fails with ErrTTLNotSupported if TTL is false.
+func (s *LibkvStore) PutTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl > 0 && !s.SupportsTTL() {
+		return ErrTTLNotSupported
+	}
+	var options *store.WriteOptions
+	if strings.HasSuffix(key, "/") || ttl > 0 {
+		options = &store.WriteOptions{IsDir: strings.HasSuffix(key, "/"), TTL: ttl}
+	}
+	return fromLibkvError(s.Store.Put(key, value, options))
+}
+
+// SupportsTTL returns TTL
+func (s *LibkvStore) SupportsTTL() bool {
+	return s.TTL
+}
+
+// Delete deletes key, or returns ErrKeyNotFound
+func (s *LibkvStore) Delete(key string) error {
+	return fromLibkvError(s.Store.Delete(key))
+}
+
+// DeleteTree deletes prefix and every key under it
+func (s *LibkvStore) DeleteTree(prefix string) error {
+	return fromLibkvError(s.Store.DeleteTree(prefix))
+}
+
+// AtomicPut writes value at key if it was not modified since previous was read
+func (s *LibkvStore) AtomicPut(key string, value []byte, previous *KvPair) (*KvPair, error) {
+	var libkvPrevious *store.KVPair
+	if previous != nil {
+		libkvPrevious = &store.KVPair{Key: previous.Key, Value: previous.Value, LastIndex: previous.LastIndex}
+	}
+	_, pair, err := s.Store.AtomicPut(key, value, libkvPrevious, nil)
+	if err != nil {
+		return nil, fromLibkvError(err)
+	}
+	if pair == nil {
+		return nil, nil
+	}
+	return fromLibkvPair(pair), nil
+}
+
+// WatchTree sends the pairs under prefix, then the new pairs after every change, until stopCh is closed
+func (s *LibkvStore) WatchTree(prefix string, stopCh <-chan struct{}) (<-chan []*KvPair, error) {
+	libkvCh, err := s.Store.WatchTree(prefix, stopCh, nil)
+	if err != nil {
+		return nil, fromLibkvError(err)
+	}
+	watchCh := make(chan []*KvPair)
+	go func() {
+		defer close(watchCh)
+		for pairs := range libkvCh {
+			select {
+			case watchCh <- fromLibkvPairs(pairs):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// NewLock creates a lock for key, renewed while it is held
+func (s *LibkvStore) NewLock(key string, ttl time.Duration) (KvLock, error) {
+	// closed to stop renewing the lock
+	renewCh := make(chan struct{})
+	locker, err := s.Store.NewLock(key, &store.LockOptions{TTL: ttl, RenewLock: renewCh})
+	if err != nil {
+		return nil, fromLibkvError(err)
+	}
+	return &libkvLock{locker: locker, renewCh: renewCh}, nil
+}
+
+// libkvLock is the KvLock of a LibkvStore
+type libkvLock struct {
+	locker    store.Locker
+	renewCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *libkvLock) Lock(stopCh chan struct{}) (<-chan struct{}, error) {
+	return l.locker.Lock(stopCh)
+}
+
+func (l *libkvLock) Unlock() error {
+	err := l.locker.Unlock()
+	l.closeOnce.Do(func() { close(l.renewCh) })
+	return fromLibkvError(err)
+}
@@ -0,0 +1,134 @@
+package staert
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testKvStore checks the behavior of a KvStore implementation
+func testKvStore(t *testing.T, s KvStore) {
+	for _, key := range []string{"prefix/vfoo", "prefix/vmap/", "prefix/vmap/key", "prefixother"} {
+		if err := s.Put(key, []byte("value")); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	pair, err := s.Get("prefix/vfoo")
+	if err != nil || pair.Key != "prefix/vfoo" || string(pair.Value) != "value" {
+		t.Fatalf("Expected prefix/vfoo, got %+v (%v)", pair, err)
+	}
+	if _, err := s.Get("prefix/vbar"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	pairs, err := s.List("prefix")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	listed := map[string]bool{}
+	for _, pair := range pairs {
+		listed[pair.Key] = true
+	}
+	if !listed["prefix/vfoo"] || !listed["prefix/vmap/"] || listed["prefixother"] {
+		t.Fatalf("Expected children of prefix, got %v", listed)
+	}
+	if _, err := s.List("prefix/vbar"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// compare-and-swap
+	if _, err := s.AtomicPut("prefix/vfoo", []byte("new"), nil); err != ErrKeyExists {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+	pair, err = s.AtomicPut("prefix/vfoo", []byte("new"), pair)
+	if err != nil || string(pair.Value) != "new" {
+		t.Fatalf("Expected prefix/vfoo to be swapped, got %+v (%v)", pair, err)
+	}
+	if _, err := s.AtomicPut("prefix/vfoo", []byte("other"), &KvPair{Key: "prefix/vfoo", LastIndex: pair.LastIndex + 1}); err != ErrKeyModified {
+		t.Fatalf("Expected ErrKeyModified, got %v", err)
+	}
+	if _, err := s.AtomicPut("prefix/vbar", []byte("bar"), nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// watch
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	watchCh, err := s.WatchTree("prefix", stopCh)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	next := func() map[string]string {
+		select {
+		case pairs := <-watchCh:
+			values := map[string]string{}
+			for _, pair := range pairs {
+				values[pair.Key] = string(pair.Value)
+			}
+			return values
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for WatchTree")
+			return nil
+		}
+	}
+	if values := next(); values["prefix/vfoo"] != "new" {
+		t.Fatalf("Expected prefix/vfoo, got %v", values)
+	}
+	if err := s.Put("prefix/vfoo", []byte("watched")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if values := next(); values["prefix/vfoo"] != "watched" {
+		t.Fatalf("Expected prefix/vfoo to be watched, got %v", values)
+	}
+
+	// delete
+	if err := s.Delete("prefix/vfoo"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := s.Delete("prefix/vfoo"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := s.DeleteTree("prefix"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.Get("prefix/vmap/key"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := s.Get("prefixother"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+}
+
+func TestKvStoreMemStore(t *testing.T) {
+	testKvStore(t, NewMemStore())
+}
+
+func TestKvStoreFileStore(t *testing.T) {
+	testKvStore(t, newTestFileStore(t))
+}
+
+// mapKvStore is a KvStore without locks, and without libkv
+type mapKvStore struct {
+	KvStore
+}
+
+func TestKvSourceCustomKvStore(t *testing.T) {
+	kv := &KvSource{Store: &mapKvStore{NewMemStore()}, Prefix: "prefix"}
+	config := &struct{ Vfoo string }{"foo"}
+	if err := kv.StoreConfig(config); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded := &struct{ Vfoo string }{}
+	if err := kv.LoadConfig(loaded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("Got %+v\nExpected: %+v", loaded, config)
+	}
+
+	// locks are not supported
+	kv.LockKey = "prefix/.lock"
+	err := kv.StoreConfig(config)
+	if err == nil || err.Error() != "cannot create lock prefix/.lock: locks not supported by the store" {
+		t.Fatalf("Expected unsupported lock error, got %v", err)
+	}
+}
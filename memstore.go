@@ -0,0 +1,476 @@
+package staert
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStore is a concurrency-safe in-memory KvStore, KvTTLStore and KvLocker
+// It can be used instead of a KV Store like Consul, by KvSource and in tests.
+// List returns every key under a directory (like Consul), keys are written with an increasing LastIndex,
+// WatchTree and Watch notify every change, and keys written with a TTL expire.
+type MemStore struct {
+	mu        sync.Mutex
+	pairs     map[string]*memPair
+	lastIndex uint64
+	// closed and replaced on every change, to wake up watchers and lockers
+	changed chan struct{}
+	closed  bool
+}
+
+type memPair struct {
+	value     []byte
+	lastIndex uint64
+	expiry    *time.Timer
+}
+
+// NewMemStore creates an empty MemStore
+func NewMemStore() *MemStore {
+	return &MemStore{
+		pairs:   map[string]*memPair{},
+		changed: make(chan struct{}),
+	}
+}
+
+// errStoreClosed is returned by the operations of a closed MemStore
+var errStoreClosed = errors.New("store closed")
+
+func normalizeMemKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+func normalizeMemDir(directory string) string {
+	return strings.Trim(directory, "/")
+}
+
+// notify wakes up watchers and lockers, s.mu must be held
+func (s *MemStore) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// put writes key, expiring after ttl (if not 0), s.mu must be held
+func (s *MemStore) put(key string, value []byte, ttl time.Duration) *KvPair {
+	if old, ok := s.pairs[key]; ok && old.expiry != nil {
+		old.expiry.Stop()
+	}
+	s.lastIndex++
+	pair := &memPair{value: append([]byte(nil), value...), lastIndex: s.lastIndex}
+	if ttl > 0 {
+		index := pair.lastIndex
+		pair.expiry = time.AfterFunc(ttl, func() { s.expire(key, index) })
+	}
+	s.pairs[key] = pair
+	s.notify()
+	return pair.kvPair(key)
+}
+
+// delete deletes key, s.mu must be held
+func (s *MemStore) delete(key string) {
+	if pair := s.pairs[key]; pair.expiry != nil {
+		pair.expiry.Stop()
+	}
+	delete(s.pairs, key)
+	s.notify()
+}
+
+// expire deletes key if it was not written since index
+func (s *MemStore) expire(key string, index uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pair, ok := s.pairs[key]; ok && pair.lastIndex == index && !s.closed {
+		s.delete(key)
+	}
+}
+
+func (p *memPair) kvPair(key string) *KvPair {
+	return &KvPair{Key: key, Value: append([]byte(nil), p.value...), LastIndex: p.lastIndex}
+}
+
+// Put writes value at key
+func (s *MemStore) Put(key string, value []byte) error {
+	return s.PutTTL(key, value, 0)
+}
+
+// PutTTL writes value at key, expiring after ttl (if not 0)
+func (s *MemStore) PutTTL(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	s.put(normalizeMemKey(key), value, ttl)
+	return nil
+}
+
+// Get returns the pair of key, or ErrKeyNotFound
+func (s *MemStore) Get(key string) (*KvPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	key = normalizeMemKey(key)
+	pair, ok := s.pairs[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return pair.kvPair(key), nil
+}
+
+// Delete deletes key, or returns ErrKeyNotFound
+func (s *MemStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	key = normalizeMemKey(key)
+	if _, ok := s.pairs[key]; !ok {
+		return ErrKeyNotFound
+	}
+	s.delete(key)
+	return nil
+}
+
+// list returns the keys under directory, sorted, s.mu must be held
+func (s *MemStore) list(directory string) []*KvPair {
+	directory = normalizeMemDir(directory)
+	var pairs []*KvPair
+	for key, pair := range s.pairs {
+		if strings.HasPrefix(key, directory+"/") {
+			pairs = append(pairs, pair.kvPair(key))
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+// List returns the pairs under directory, at any depth
+// It returns ErrKeyNotFound if there is neither a key nor a directory at directory.
+func (s *MemStore) List(directory string) ([]*KvPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	pairs := s.list(directory)
+	if len(pairs) == 0 {
+		if _, ok := s.pairs[normalizeMemDir(directory)]; !ok {
+			return nil, ErrKeyNotFound
+		}
+	}
+	return pairs, nil
+}
+
+// ListsRecursively returns true : List returns the pairs at any depth
+func (s *MemStore) ListsRecursively() bool {
+	return true
+}
+
+// DeleteTree deletes a range of keys under a given directory, and the directory key
+func (s *MemStore) DeleteTree(directory string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	for _, pair := range s.list(directory) {
+		s.delete(pair.Key)
+	}
+	for _, key := range []string{normalizeMemDir(directory), normalizeMemDir(directory) + "/"} {
+		if _, ok := s.pairs[key]; ok {
+			s.delete(key)
+		}
+	}
+	return nil
+}
+
+// AtomicPut writes value at key if it was not modified since previous was read
+// If previous is nil, key must not exist.
+func (s *MemStore) AtomicPut(key string, value []byte, previous *KvPair) (*KvPair, error) {
+	return s.atomicPut(key, value, previous, 0)
+}
+
+// atomicPut writes value at key like AtomicPut, expiring after ttl (if not 0)
+func (s *MemStore) atomicPut(key string, value []byte, previous *KvPair, ttl time.Duration) (*KvPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	key = normalizeMemKey(key)
+	pair, ok := s.pairs[key]
+	switch {
+	case previous == nil && ok:
+		return nil, ErrKeyExists
+	case previous != nil && !ok:
+		return nil, ErrKeyNotFound
+	case previous != nil && pair.lastIndex != previous.LastIndex:
+		return nil, ErrKeyModified
+	}
+	return s.put(key, value, ttl), nil
+}
+
+// AtomicDelete deletes key if it was not modified since previous was read, or returns ErrKeyNotFound or ErrKeyModified
+func (s *MemStore) AtomicDelete(key string, previous *KvPair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	key = normalizeMemKey(key)
+	pair, ok := s.pairs[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if pair.lastIndex != previous.LastIndex {
+		return ErrKeyModified
+	}
+	s.delete(key)
+	return nil
+}
+
+// watch sends on a new channel the value returned by snapshot, then every time it changes, until stopCh is closed
+// snapshot is called with s.mu held, and returns false if there is nothing to send.
+func (s *MemStore) watch(stopCh <-chan struct{}, snapshot func() (interface{}, bool)) <-chan interface{} {
+	watchCh := make(chan interface{})
+	go func() {
+		defer close(watchCh)
+		for {
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				return
+			}
+			value, ok := snapshot()
+			changed := s.changed
+			s.mu.Unlock()
+
+			if ok {
+				select {
+				case watchCh <- value:
+				case <-stopCh:
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return watchCh
+}
+
+// Watch sends the pair of key (if it exists), then every new value, until stopCh is closed
+func (s *MemStore) Watch(key string, stopCh <-chan struct{}) (<-chan *KvPair, error) {
+	if s.isClosed() {
+		return nil, errStoreClosed
+	}
+	key = normalizeMemKey(key)
+	var lastIndex uint64
+	values := s.watch(stopCh, func() (interface{}, bool) {
+		pair, ok := s.pairs[key]
+		if !ok || pair.lastIndex == lastIndex {
+			return nil, false
+		}
+		lastIndex = pair.lastIndex
+		return pair.kvPair(key), true
+	})
+	watchCh := make(chan *KvPair)
+	go func() {
+		defer close(watchCh)
+		for value := range values {
+			select {
+			case watchCh <- value.(*KvPair):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// WatchTree sends the pairs under directory, then the new pairs after every change, until stopCh is closed
+func (s *MemStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*KvPair, error) {
+	if s.isClosed() {
+		return nil, errStoreClosed
+	}
+	var last []*KvPair
+	first := true
+	values := s.watch(stopCh, func() (interface{}, bool) {
+		pairs := s.list(directory)
+		if !first && samePairs(pairs, last) {
+			return nil, false
+		}
+		first = false
+		last = pairs
+		return pairs, true
+	})
+	watchCh := make(chan []*KvPair)
+	go func() {
+		defer close(watchCh)
+		for value := range values {
+			select {
+			case watchCh <- value.([]*KvPair):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return watchCh, nil
+}
+
+// samePairs returns true if the sorted lists of pairs have the same keys and indexes
+func samePairs(pairs1, pairs2 []*KvPair) bool {
+	if len(pairs1) != len(pairs2) {
+		return false
+	}
+	for i := range pairs1 {
+		if pairs1[i].Key != pairs2[i].Key || pairs1[i].LastIndex != pairs2[i].LastIndex {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *MemStore) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// NewLock creates a lock for key
+// If ttl is set, the lock key expires after ttl unless it is renewed : it is renewed while it is held.
+func (s *MemStore) NewLock(key string, ttl time.Duration) (KvLock, error) {
+	return &memLock{store: s, key: normalizeMemKey(key), ttl: ttl}, nil
+}
+
+// Close the store : watches are stopped, and every operation fails
+func (s *MemStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, pair := range s.pairs {
+		if pair.expiry != nil {
+			pair.expiry.Stop()
+		}
+	}
+	s.closed = true
+	s.notify()
+}
+
+// memLock is the KvLock of a MemStore
+type memLock struct {
+	store *MemStore
+	key   string
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	pair   *KvPair
+	stopCh chan struct{}
+}
+
+// Lock waits until the lock is acquired or stopChan is closed (then it returns a nil channel)
+// The returned channel is closed when the lock is lost.
+func (l *memLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	for {
+		l.store.mu.Lock()
+		changed := l.store.changed
+		l.store.mu.Unlock()
+
+		pair, err := l.store.atomicPut(l.key, nil, nil, l.ttl)
+		if err == nil {
+			l.mu.Lock()
+			l.pair = pair
+			l.stopCh = make(chan struct{})
+			l.mu.Unlock()
+			lostCh := make(chan struct{})
+			go l.hold(lostCh, l.stopCh)
+			return lostCh, nil
+		}
+		if err != ErrKeyExists {
+			return nil, err
+		}
+		select {
+		case <-changed:
+		case <-stopChan:
+			return nil, nil
+		}
+	}
+}
+
+// hold renews the lock until it is unlocked, and closes lostCh if it is lost
+func (l *memLock) hold(lostCh, stopCh chan struct{}) {
+	defer close(lostCh)
+	var renew <-chan time.Time
+	if l.ttl > 0 {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		renew = ticker.C
+	}
+	for {
+		// l.mu is never taken while holding l.store.mu : Unlock and the renewal take them in the other order
+		l.mu.Lock()
+		held := l.pair != nil
+		var lastIndex uint64
+		if held {
+			lastIndex = l.pair.LastIndex
+		}
+		l.mu.Unlock()
+		if !held {
+			return
+		}
+		l.store.mu.Lock()
+		pair, ok := l.store.pairs[l.key]
+		held = ok && pair.lastIndex == lastIndex
+		changed := l.store.changed
+		closed := l.store.closed
+		l.store.mu.Unlock()
+		if !held || closed {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-stopCh:
+			return
+		case <-renew:
+			l.mu.Lock()
+			if l.pair == nil {
+				// unlocked while renewing : a renewal would take the lock again
+				l.mu.Unlock()
+				return
+			}
+			pair, err := l.store.atomicPut(l.key, nil, l.pair, l.ttl)
+			if err == nil {
+				l.pair = pair
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Unlock releases the lock, and stops renewing it
+func (l *memLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pair == nil {
+		return errors.New("lock not held")
+	}
+	close(l.stopCh)
+	err := l.store.AtomicDelete(l.key, l.pair)
+	l.pair = nil
+	if err == ErrKeyNotFound || err == ErrKeyModified {
+		// lost
+		return nil
+	}
+	return err
+}
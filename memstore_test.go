@@ -0,0 +1,304 @@
+package staert
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pairKeys(pairs []*KvPair) []string {
+	keys := []string{}
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+	return keys
+}
+
+func TestMemStoreBasic(t *testing.T) {
+	s := NewMemStore()
+	for _, key := range []string{"prefix/vfoo", "prefix/vmap/", "prefix/vmap/key", "prefixother"} {
+		if err := s.Put(key, []byte("value")); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	pair, err := s.Get("/prefix/vfoo")
+	if err != nil || string(pair.Value) != "value" || pair.LastIndex != 1 {
+		t.Fatalf("Expected prefix/vfoo at index 1, got %+v (%v)", pair, err)
+	}
+	if _, err := s.Get("prefix/vbar"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	pairs, err := s.List("prefix")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []string{"prefix/vfoo", "prefix/vmap/", "prefix/vmap/key"}
+	if !reflect.DeepEqual(pairKeys(pairs), expected) {
+		t.Fatalf("Got %v\nExpected: %v", pairKeys(pairs), expected)
+	}
+	if pairs, err := s.List("prefix/vfoo"); err != nil || len(pairs) != 0 {
+		t.Fatalf("Expected empty list for a leaf, got %v (%v)", pairs, err)
+	}
+	if _, err := s.List("prefix/vbar"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := s.DeleteTree("prefix/vmap"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := s.Delete("prefix/vfoo"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := s.Delete("prefix/vfoo"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := s.Get("prefixother"); err != nil {
+		t.Fatalf("Expected prefixother to exist, got %v", err)
+	}
+	if _, err := s.List("prefix"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestMemStoreAtomic(t *testing.T) {
+	s := NewMemStore()
+	pair, err := s.AtomicPut("key", []byte("1"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.AtomicPut("key", []byte("2"), nil); err != ErrKeyExists {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+	if _, err := s.AtomicPut("other", []byte("2"), pair); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	pair2, err := s.AtomicPut("key", []byte("2"), pair)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.AtomicPut("key", []byte("3"), pair); err != ErrKeyModified {
+		t.Fatalf("Expected ErrKeyModified, got %v", err)
+	}
+	if err := s.AtomicDelete("key", pair); err != ErrKeyModified {
+		t.Fatalf("Expected ErrKeyModified, got %v", err)
+	}
+	if err := s.AtomicDelete("key", pair2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := s.Get("key"); err != ErrKeyNotFound {
+		t.Fatal("Expected key to be deleted")
+	}
+}
+
+func TestMemStoreTTL(t *testing.T) {
+	s := NewMemStore()
+	if err := s.PutTTL("ephemeral", []byte("value"), 20*time.Millisecond); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := s.PutTTL("renewed", []byte("value"), 20*time.Millisecond); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// written again without TTL, it does not expire anymore
+	if err := s.Put("renewed", []byte("value")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := s.Get("ephemeral"); err != ErrKeyNotFound {
+		t.Fatal("Expected ephemeral to expire")
+	}
+	if _, err := s.Get("renewed"); err != nil {
+		t.Fatal("Expected renewed not to expire")
+	}
+}
+
+func TestMemStoreWatchTree(t *testing.T) {
+	s := NewMemStore()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := s.Put("prefix/vfoo", []byte("foo")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	treeCh, err := s.WatchTree("prefix", stopCh)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	keyCh, err := s.Watch("prefix/vbar", stopCh)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	next := func() []string {
+		select {
+		case pairs := <-treeCh:
+			return pairKeys(pairs)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for WatchTree")
+			return nil
+		}
+	}
+	if keys := next(); !reflect.DeepEqual(keys, []string{"prefix/vfoo"}) {
+		t.Fatalf("Got %v", keys)
+	}
+	// changes outside of the tree are not sent
+	if err := s.Put("other", []byte("other")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := s.Put("prefix/vbar", []byte("bar")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if keys := next(); !reflect.DeepEqual(keys, []string{"prefix/vbar", "prefix/vfoo"}) {
+		t.Fatalf("Got %v", keys)
+	}
+	select {
+	case pair := <-keyCh:
+		if string(pair.Value) != "bar" {
+			t.Fatalf("Got %+v", pair)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for Watch")
+	}
+	if err := s.Delete("prefix/vfoo"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if keys := next(); !reflect.DeepEqual(keys, []string{"prefix/vbar"}) {
+		t.Fatalf("Got %v", keys)
+	}
+
+	// watches are stopped when the store is closed
+	s.Close()
+	if _, ok := <-treeCh; ok {
+		t.Fatal("Expected WatchTree channel to be closed")
+	}
+	if _, err := s.Get("prefix/vbar"); err == nil {
+		t.Fatal("Expected an error on a closed store")
+	}
+}
+
+func TestMemStoreLock(t *testing.T) {
+	s := NewMemStore()
+	locker1, _ := s.NewLock("lock", 150*time.Millisecond)
+	locker2, _ := s.NewLock("lock", 0)
+	lostCh, err := locker1.Lock(nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// the lock is renewed while it is held
+	time.Sleep(400 * time.Millisecond)
+	if _, err := s.Get("lock"); err != nil {
+		t.Fatalf("Expected the lock to be held, got %v", err)
+	}
+	select {
+	case <-lostCh:
+		t.Fatal("Expected the lock to be renewed")
+	default:
+	}
+	stopCh := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(stopCh) })
+	if lost, err := locker2.Lock(stopCh); lost != nil || err != nil {
+		t.Fatalf("Expected Lock to be stopped, got %v (%v)", lost, err)
+	}
+
+	// the lock is acquired by the second locker as soon as it is released
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := locker2.Lock(nil); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := locker1.Unlock(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	wg.Wait()
+	if _, ok := <-lostCh; ok {
+		t.Fatal("Expected lost channel to be closed")
+	}
+	if _, err := s.Get("lock"); err != nil {
+		t.Fatalf("Expected the lock to be held by the second locker, got %v", err)
+	}
+	if err := locker2.Unlock(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := locker2.Unlock(); err == nil {
+		t.Fatal("Expected an error unlocking a released lock")
+	}
+}
+
+func TestMemStoreLockConcurrentWrites(t *testing.T) {
+	s := NewMemStore()
+	locker, _ := s.NewLock("lock", 30*time.Millisecond)
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				if err := s.Put("key/"+string(rune('a'+i)), []byte("value")); err != nil {
+					t.Errorf("Error: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	// unlocking while the lock is checked after every write must not deadlock
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			if _, err := locker.Lock(nil); err != nil {
+				t.Errorf("Error: %v", err)
+				return
+			}
+			if err := locker.Unlock(); err != nil {
+				t.Errorf("Error: %v", err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected Lock and Unlock not to deadlock with concurrent writes")
+	}
+	close(stopCh)
+	wg.Wait()
+}
+
+func TestMemStoreConcurrentKvSources(t *testing.T) {
+	s := NewMemStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kv := &KvSource{Store: s, Prefix: "prefix", LockKey: "prefix/.lock"}
+			for j := 0; j < 10; j++ {
+				if err := kv.PublishConfig(&struct{ Vfoo string }{"foo"}); err != nil {
+					t.Errorf("Error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	kv := &KvSource{Store: s, Prefix: "prefix"}
+	if version, _, err := kv.currentVersion(); err != nil || version != 80 {
+		t.Fatalf("Expected version 80, got %d (%v)", version, err)
+	}
+	config := &struct{ Vfoo string }{}
+	if err := kv.LoadConfig(config); err != nil || config.Vfoo != "foo" {
+		t.Fatalf("Expected published config, got %+v (%v)", config, err)
+	}
+}
@@ -1,10 +1,15 @@
 package staert
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -86,114 +91,703 @@ func (s *Staert) Run() error {
 
 //TomlSource impement Source
 type TomlSource struct {
+	fsys         tomlFS
 	filename     string
 	dirNfullpath []string
+	reader       io.Reader
+	data         []byte
 	fullpath     string
+	fullpaths    []string
+	dirMode      bool
+	profile      string
+	profileArgs  []string
+	profileFlag  string
+	profileEnv   string
+	required     bool
 }
 
+const (
+	// tomlIncludeKey is the top level key listing the files to merge over a TOML file
+	tomlIncludeKey = "include"
+	// tomlProfilesKey is the top level table containing one table per profile
+	tomlProfilesKey = "profiles"
+)
+
 // NewTomlSource creates and return a pointer on TomlSource.
 // Parameter filename is the file name (without extension type, ".toml" will be added)
 // dirNfullpath may contain directories or fullpath to the file.
+// They may start with "~", contain environment variables ($VAR or ${VAR}) and glob patterns.
+// The fullpath "-" reads the file from stdin.
 func NewTomlSource(filename string, dirNfullpath []string) *TomlSource {
-	return &TomlSource{filename, dirNfullpath, ""}
+	return &TomlSource{fsys: osFS{}, filename: filename, dirNfullpath: dirNfullpath}
+}
+
+// NewTomlDirSource creates and return a pointer on TomlSource which merges every ".toml" file found in dirs.
+// Files are merged in lexical order, directory after directory, later files overriding earlier ones.
+func NewTomlDirSource(dirs []string) *TomlSource {
+	return &TomlSource{fsys: osFS{}, dirNfullpath: dirs, dirMode: true}
+}
+
+// NewTomlFSSource creates and return a pointer on TomlSource which reads the file from fsys (like an embed.FS).
+// Parameters filename and dirNfullpath work as with NewTomlSource, with slash-separated paths relative to the root of fsys.
+func NewTomlFSSource(fsys fs.FS, filename string, dirNfullpath []string) *TomlSource {
+	return &TomlSource{fsys: ioFS{fsys}, filename: filename, dirNfullpath: dirNfullpath}
+}
+
+// NewTomlReaderSource creates and return a pointer on TomlSource which reads the TOML document from reader.
+// The reader is read once, on the first Parse. Included files are relative to the working directory.
+func NewTomlReaderSource(reader io.Reader) *TomlSource {
+	return &TomlSource{fsys: osFS{}, reader: reader}
+}
+
+// NewTomlBytesSource creates and return a pointer on TomlSource which reads the TOML document from data.
+// Included files are relative to the working directory.
+func NewTomlBytesSource(data []byte) *TomlSource {
+	return &TomlSource{fsys: osFS{}, data: data}
 }
 
 // ConfigFileUsed return config file used
+// If many files were merged, it returns the first one (see ConfigFilesUsed)
 func (ts *TomlSource) ConfigFileUsed() string {
 	return ts.fullpath
 }
 
+// ConfigFilesUsed return all config files which contributed to the config, in merge order
+func (ts *TomlSource) ConfigFilesUsed() []string {
+	return ts.fullpaths
+}
+
+// SetRequired makes Parse fail, listing every candidate tried, when no file is found
+func (ts *TomlSource) SetRequired(required bool) {
+	ts.required = required
+}
+
+// SetProfile selects the profiles to overlay on the base document, like "dev" or "dev,local".
+// It takes precedence over profiles selected by flag or environment variable.
+func (ts *TomlSource) SetProfile(profile string) {
+	ts.profile = profile
+}
+
+// SetProfileFlag selects the profiles from the flag flagName in args (like "--profile=dev" or "--profile dev").
+// It takes precedence over the profiles selected by environment variable.
+func (ts *TomlSource) SetProfileFlag(args []string, flagName string) {
+	ts.profileArgs = args
+	ts.profileFlag = flagName
+}
+
+// SetProfileEnv selects the profiles from the environment variable envName
+func (ts *TomlSource) SetProfileEnv(envName string) {
+	ts.profileEnv = envName
+}
+
+// Profiles returns the selected profiles, in overlay order
+func (ts *TomlSource) Profiles() []string {
+	profile := ts.profile
+	if len(profile) == 0 && len(ts.profileFlag) > 0 {
+		profile = getFlagValue(ts.profileArgs, ts.profileFlag)
+	}
+	if len(profile) == 0 && len(ts.profileEnv) > 0 {
+		profile = os.Getenv(ts.profileEnv)
+	}
+	var profiles []string
+	for _, p := range strings.Split(profile, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles
+}
+
+// getFlagValue returns the value of the flag flagName in args, or an empty string
+func getFlagValue(args []string, flagName string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if len(name) == len(arg) {
+			continue
+		}
+		if strings.HasPrefix(name, flagName+"=") {
+			return name[len(flagName)+1:]
+		}
+		if name == flagName && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// XDGConfigDirs returns the XDG base directories where the config of the application name should be searched :
+// $XDG_CONFIG_HOME/<name> (default ~/.config/<name>), then each $XDG_CONFIG_DIRS/<name> (default /etc/xdg/<name>)
+func XDGConfigDirs(name string) []string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if len(configHome) == 0 {
+		configHome = filepath.Join("~", ".config")
+	}
+	dirs := []string{filepath.Join(configHome, name)}
+	configDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if len(configDirs) == 0 {
+		configDirs = "/etc/xdg"
+	}
+	for _, dir := range filepath.SplitList(configDirs) {
+		if len(dir) > 0 {
+			dirs = append(dirs, filepath.Join(dir, name))
+		}
+	}
+	return dirs
+}
+
+// preprocessDir expands a leading "~" and the environment variables ($VAR or ${VAR}) of dirIn
+// It returns an absolute path, or an error if a variable is not set
 func preprocessDir(dirIn string) (string, error) {
 	dirOut := dirIn
-	if strings.HasPrefix(dirIn, "$") {
-		end := strings.Index(dirIn, string(os.PathSeparator))
-		if end == -1 {
-			end = len(dirIn)
+	if dirOut == "~" || strings.HasPrefix(dirOut, "~/") || strings.HasPrefix(dirOut, "~"+string(os.PathSeparator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dirOut = home + dirOut[1:]
+	}
+	var missing []string
+	dirOut = os.Expand(dirOut, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
 		}
-		dirOut = os.Getenv(dirIn[1:end]) + dirIn[end:]
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s not set in %s", strings.Join(missing, ", "), dirIn)
 	}
-	dirOut, err := filepath.Abs(dirOut)
-	return dirOut, err
+	return filepath.Abs(dirOut)
+}
+
+// expandPath calls preprocessDir on pathIn, then expands its glob patterns
+// Matches are sorted in lexical order
+func expandPath(pathIn string) ([]string, error) {
+	fullPath, err := preprocessDir(pathIn)
+	if err != nil {
+		return nil, err
+	}
+	if !hasGlobMeta(fullPath) {
+		return []string{fullPath}, nil
+	}
+	return filepath.Glob(fullPath)
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+func isFile(fullPath string) bool {
+	fileInfo, err := os.Stat(fullPath)
+	return err == nil && !fileInfo.IsDir()
 }
 
 func findFile(filename string, dirNfile []string) string {
+	fullPath, _ := searchFile(osFS{}, filename, dirNfile)
+	return fullPath
+}
+
+// searchFile returns the first file found in dirNfile, given by its fullpath or as filename.toml in a directory
+// It also returns every candidate tried
+func searchFile(fsys tomlFS, filename string, dirNfile []string) (string, []string) {
+	var tried []string
 	for _, df := range dirNfile {
-		if df != "" {
-			fullPath, _ := preprocessDir(df)
-			if fileInfo, err := os.Stat(fullPath); err == nil && !fileInfo.IsDir() {
-				return fullPath
+		if df == "" {
+			continue
+		}
+		fullPaths, err := fsys.expand(df)
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s (%v)", df, err))
+			continue
+		}
+		if len(fullPaths) == 0 {
+			tried = append(tried, fmt.Sprintf("%s (no match)", df))
+		}
+		for _, fullPath := range fullPaths {
+			tried = append(tried, fullPath)
+			if fsys.isFile(fullPath) {
+				return fullPath, tried
 			}
-			fullPath = fullPath + "/" + filename + ".toml"
-			if fileInfo, err := os.Stat(fullPath); err == nil && !fileInfo.IsDir() {
-				return fullPath
+			fullPath = fsys.join(fullPath, filename+".toml")
+			tried = append(tried, fullPath)
+			if fsys.isFile(fullPath) {
+				return fullPath, tried
 			}
 		}
 	}
-	return ""
+	return "", tried
 }
 
-// Parse calls toml.DecodeFile() func
-func (ts *TomlSource) Parse(cmd *flaeg.Command) (*flaeg.Command, error) {
-	ts.fullpath = findFile(ts.filename, ts.dirNfullpath)
-	if len(ts.fullpath) < 2 {
-		return cmd, nil
+// findDirFiles returns every ".toml" file found in dirs, sorted in lexical order within each directory
+// It also returns every directory tried
+func findDirFiles(fsys tomlFS, dirs []string) ([]string, []string) {
+	var files []string
+	var tried []string
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		fullPaths, err := fsys.expand(dir)
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s (%v)", dir, err))
+			continue
+		}
+		if len(fullPaths) == 0 {
+			tried = append(tried, fmt.Sprintf("%s (no match)", dir))
+		}
+		for _, fullPath := range fullPaths {
+			tried = append(tried, fullPath)
+			matches, err := globFiles(fsys, fsys.join(fullPath, "*.toml"))
+			if err != nil {
+				continue
+			}
+			files = append(files, matches...)
+		}
 	}
-	metadata, err := toml.DecodeFile(ts.fullpath, cmd.Config)
-	if err != nil {
-		return nil, err
+	return files, tried
+}
+
+// tomlKey is a key defined in a TOML file, with its TOML type
+type tomlKey struct {
+	toml.Key
+	Type string
+}
+
+// tomlPart is a parsed TOML file, its top level values are kept undecoded
+type tomlPart struct {
+	metadata   toml.MetaData
+	primitives map[string]toml.Primitive
+}
+
+// values decodes the top level values of the part
+func (part *tomlPart) values() (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(part.primitives))
+	for key, primitive := range part.primitives {
+		var value interface{}
+		if err := part.metadata.PrimitiveDecode(primitive, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
 	}
-	boolFlags, err := flaeg.GetBoolFlags(cmd.Config)
+	return values, nil
+}
+
+// tomlDocument is the result of merging TOML files
+// keys lists the keys defined in the files, in merge order
+// overlays lists the tables of the selected profiles, merged over the parts
+type tomlDocument struct {
+	parts    []*tomlPart
+	keys     []tomlKey
+	files    []string
+	overlays []map[string]interface{}
+}
+
+func newTomlDocument() *tomlDocument {
+	return &tomlDocument{}
+}
+
+// mergeFile reads the TOML file from fsys and merges it over the document
+func (doc *tomlDocument) mergeFile(fsys tomlFS, fullpath string, visited map[string]bool) error {
+	if visited[fullpath] {
+		return fmt.Errorf("include cycle detected on file %s", fullpath)
+	}
+	visited[fullpath] = true
+	defer delete(visited, fullpath)
+
+	content, err := fsys.readFile(fullpath)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	doc.files = append(doc.files, fullpath)
+	if err := doc.merge(fsys, fullpath, content, visited); err != nil {
+		return fmt.Errorf("file %s: %v", fullpath, err)
 	}
-	flaegArgs, hasUnderField, err := generateArgs(metadata, boolFlags)
+	return nil
+}
+
+// merge merges the files included by the TOML content over the document, then the TOML content over them :
+// the keys of the including file override the ones of the files it includes
+// Included files are relative to the directory of name
+func (doc *tomlDocument) merge(fsys tomlFS, name string, content []byte, visited map[string]bool) error {
+	part := &tomlPart{primitives: map[string]toml.Primitive{}}
+	var err error
+	part.metadata, err = toml.Decode(string(content), &part.primitives)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	var includes []string
+	if primitive, ok := part.primitives[tomlIncludeKey]; ok {
+		delete(part.primitives, tomlIncludeKey)
+		var rawIncludes interface{}
+		if err := part.metadata.PrimitiveDecode(primitive, &rawIncludes); err != nil {
+			return err
+		}
+		if includes, err = parseIncludes(rawIncludes); err != nil {
+			return err
+		}
+	}
+	for _, include := range includes {
+		if !fsys.isAbs(include) {
+			include = fsys.join(fsys.dir(name), include)
+		}
+		matches, err := globFiles(fsys, include)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 && !hasGlobMeta(include) {
+			return fmt.Errorf("included file %s not found", include)
+		}
+		for _, match := range matches {
+			if err := doc.mergeFile(fsys, match, visited); err != nil {
+				return err
+			}
+		}
 	}
 
-	// fmt.Println(flaegArgs)
-	err = flaeg.Load(cmd.Config, cmd.DefaultPointersConfig, flaegArgs)
-	//if err!= missing parser err
-	if err != nil && err != flaeg.ErrParserNotFound {
-		return nil, err
+	doc.parts = append(doc.parts, part)
+	for _, key := range part.metadata.Keys() {
+		if key[0] == tomlIncludeKey {
+			continue
+		}
+		doc.keys = append(doc.keys, tomlKey{Key: key, Type: part.metadata.Type(key.String())})
+	}
+	return nil
+}
+
+// applyProfiles removes the profiles tables from the document, then selects the given profiles as overlays, in order
+func (doc *tomlDocument) applyProfiles(profiles []string) error {
+	profilesData := map[string]interface{}{}
+	for _, part := range doc.parts {
+		primitive, ok := part.primitives[tomlProfilesKey]
+		if !ok {
+			continue
+		}
+		delete(part.primitives, tomlProfilesKey)
+		var rawProfiles interface{}
+		if err := part.metadata.PrimitiveDecode(primitive, &rawProfiles); err != nil {
+			return err
+		}
+		partProfiles, ok := rawProfiles.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a table, got %#v", tomlProfilesKey, rawProfiles)
+		}
+		mergeTomlMaps(profilesData, partProfiles)
+	}
+
+	var keys []tomlKey
+	for _, key := range doc.keys {
+		if key.Key[0] != tomlProfilesKey {
+			keys = append(keys, key)
+		}
+	}
+	for _, profile := range profiles {
+		profileData, ok := profilesData[profile].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("profile %s not found", profile)
+		}
+		doc.overlays = append(doc.overlays, profileData)
+		for _, key := range doc.keys {
+			if len(key.Key) > 2 && key.Key[0] == tomlProfilesKey && key.Key[1] == profile {
+				keys = append(keys, tomlKey{Key: key.Key[2:], Type: key.Type})
+			}
+		}
+	}
+	doc.keys = keys
+	return nil
+}
+
+// decode decodes the document into config
+// A single part is decoded field by field from its parsed values,
+// otherwise parts and overlays are merged then encoded back to be decoded.
+func (doc *tomlDocument) decode(config interface{}) error {
+	configValue := reflect.Indirect(reflect.ValueOf(config))
+	if len(doc.parts) == 1 && len(doc.overlays) == 0 && configValue.Kind() == reflect.Struct {
+		part := doc.parts[0]
+		keys := make([]string, 0, len(part.primitives))
+		for key := range part.primitives {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := findTomlField(configValue, key)
+			if !ok || !field.CanSet() {
+				continue
+			}
+			if err := part.metadata.PrimitiveDecode(part.primitives[key], field.Addr().Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	if hasUnderField {
-		_, err := toml.DecodeFile(ts.fullpath, cmd.Config)
+
+	data := map[string]interface{}{}
+	for _, part := range doc.parts {
+		values, err := part.values()
 		if err != nil {
-			return nil, err
+			return err
 		}
+		mergeTomlMaps(data, values)
+	}
+	for _, overlay := range doc.overlays {
+		mergeTomlMaps(data, overlay)
 	}
+	buffer := &bytes.Buffer{}
+	if err := toml.NewEncoder(buffer).Encode(data); err != nil {
+		return err
+	}
+	_, err := toml.Decode(buffer.String(), config)
+	return err
+}
 
-	return cmd, nil
+// parseIncludes returns the patterns of the include directive
+func parseIncludes(rawIncludes interface{}) ([]string, error) {
+	switch includes := rawIncludes.(type) {
+	case string:
+		return []string{includes}, nil
+	case []interface{}:
+		patterns := make([]string, len(includes))
+		for i, include := range includes {
+			pattern, ok := include.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain strings, got %#v", tomlIncludeKey, include)
+			}
+			patterns[i] = pattern
+		}
+		return patterns, nil
+	default:
+		return nil, fmt.Errorf("%s must be a string or an array of strings, got %#v", tomlIncludeKey, rawIncludes)
+	}
 }
 
-func generateArgs(metadata toml.MetaData, flags []string) ([]string, bool, error) {
-	var flaegArgs []string
-	keys := metadata.Keys()
-	hasUnderField := false
-	for i, key := range keys {
-		// fmt.Println(key)
-		if metadata.Type(key.String()) == "Hash" {
-			// TOML hashes correspond to Go structs or maps.
-			// fmt.Printf("%s could be a ptr on a struct, or a map\n", key)
-			for j := i; j < len(keys); j++ {
-				// fmt.Printf("%s =? %s\n", keys[j].String(), "."+key.String())
-				if strings.Contains(keys[j].String(), key.String()+".") {
-					hasUnderField = true
+// mergeTomlMaps merges src into dst, src values overriding dst ones.
+// Tables are merged recursively, any other value (including arrays) is replaced.
+// Keys are matched case-insensitively, like the TOML decoder does on struct fields.
+func mergeTomlMaps(dst map[string]interface{}, src map[string]interface{}) {
+	for srcKey, srcValue := range src {
+		dstKey := srcKey
+		if _, ok := dst[dstKey]; !ok {
+			for k := range dst {
+				if strings.EqualFold(k, srcKey) {
+					dstKey = k
 					break
 				}
 			}
-			match := false
-			for _, flag := range flags {
-				if flag == strings.ToLower(key.String()) {
-					match = true
-					break
+		}
+		dstMap, dstIsMap := dst[dstKey].(map[string]interface{})
+		srcMap, srcIsMap := srcValue.(map[string]interface{})
+		if dstIsMap && srcIsMap {
+			mergeTomlMaps(dstMap, srcMap)
+			continue
+		}
+		dst[dstKey] = srcValue
+	}
+}
+
+// load reads and merges the TOML document, it returns nil if no file is found
+func (ts *TomlSource) load() (*tomlDocument, error) {
+	doc := newTomlDocument()
+	if ts.reader != nil {
+		data, err := ioutil.ReadAll(ts.reader)
+		if err != nil {
+			return nil, err
+		}
+		ts.data = data
+		ts.reader = nil
+	}
+	if ts.data != nil {
+		if err := doc.merge(ts.fsys, "", ts.data, map[string]bool{}); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	var files, tried []string
+	if ts.dirMode {
+		files, tried = findDirFiles(ts.fsys, ts.dirNfullpath)
+	} else {
+		var fullpath string
+		fullpath, tried = searchFile(ts.fsys, ts.filename, ts.dirNfullpath)
+		if len(fullpath) > 0 {
+			files = []string{fullpath}
+		}
+	}
+	if len(files) == 0 {
+		if ts.required {
+			if ts.dirMode {
+				return nil, fmt.Errorf("no TOML config file found, tried: %s", strings.Join(tried, ", "))
+			}
+			return nil, fmt.Errorf("TOML config file %s.toml not found, tried: %s", ts.filename, strings.Join(tried, ", "))
+		}
+		return nil, nil
+	}
+	for _, file := range files {
+		if err := doc.mergeFile(ts.fsys, file, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Parse merges the TOML files found, enables pointers on the tables defined, and decodes the document
+func (ts *TomlSource) Parse(cmd *flaeg.Command) (*flaeg.Command, error) {
+	doc, err := ts.load()
+	if err != nil {
+		return nil, err
+	}
+	ts.fullpath = ""
+	ts.fullpaths = nil
+	if doc == nil {
+		return cmd, nil
+	}
+	ts.fullpaths = doc.files
+	if len(doc.files) > 0 {
+		ts.fullpath = doc.files[0]
+	}
+	if err := doc.applyProfiles(ts.Profiles()); err != nil {
+		return nil, err
+	}
+	// pointers are enabled before decoding, so the document is decoded only once
+	enablePointers(cmd.Config, cmd.DefaultPointersConfig, doc.keys)
+	if err := doc.decode(cmd.Config); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// enablePointers sets the pointer on struct fields matching a TOML table to their value in defaultPointersConfig,
+// or to a new zero value, as flaeg does with pointer flags.
+// Tables are processed parents first, every table only once.
+// Tables are taken from keys (not from the merged data), because only explicit tables enable pointers.
+func enablePointers(config interface{}, defaultPointersConfig interface{}, keys []tomlKey) {
+	var tables []toml.Key
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key.Type != "Hash" {
+			continue
+		}
+		lowerKey := strings.ToLower(key.String())
+		if !seen[lowerKey] {
+			seen[lowerKey] = true
+			tables = append(tables, key.Key)
+		}
+	}
+	sort.SliceStable(tables, func(i, j int) bool {
+		return len(tables[i]) < len(tables[j])
+	})
+
+	configValue := reflect.ValueOf(config)
+	defaultValue := reflect.ValueOf(defaultPointersConfig)
+	for _, table := range tables {
+		enablePointer(configValue, defaultValue, table)
+	}
+}
+
+// enablePointer follows the path of the table through the struct fields of value (and defaultValue)
+// If the last field is a pointer on a struct, it is set to its default value
+// Nil pointers on the path are set to their default value too
+func enablePointer(value reflect.Value, defaultValue reflect.Value, table toml.Key) {
+	for i, name := range table {
+		value = reflect.Indirect(value)
+		if defaultValue.IsValid() && defaultValue.Kind() == reflect.Ptr {
+			defaultValue = defaultValue.Elem()
+		}
+		if value.Kind() != reflect.Struct {
+			return
+		}
+		field, ok := findTomlField(value, name)
+		if !ok {
+			return
+		}
+		var defaultField reflect.Value
+		if defaultValue.IsValid() && defaultValue.Kind() == reflect.Struct {
+			defaultField, _ = findTomlField(defaultValue, name)
+		}
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct && field.CanSet() &&
+			(i == len(table)-1 || field.IsNil()) {
+			field.Set(defaultPointer(field.Type(), defaultField))
+		}
+		value = field
+		defaultValue = defaultField
+	}
+}
+
+// findTomlField returns the exported field of structValue matching a TOML key, as the TOML decoder does:
+// by toml tag, or by field name (case-insensitive), promoting fields of embedded structs
+func findTomlField(structValue reflect.Value, name string) (reflect.Value, bool) {
+	structType := structValue.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if len(field.PkgPath) > 0 && !field.Anonymous {
+			//if unexported field
+			continue
+		}
+		fieldName := field.Name
+		if tag := strings.Split(field.Tag.Get("toml"), ",")[0]; len(tag) > 0 {
+			fieldName = tag
+		}
+		if fieldName == "-" {
+			continue
+		}
+		if field.Anonymous && len(field.Tag.Get("toml")) == 0 {
+			embedded := reflect.Indirect(structValue.Field(i))
+			if embedded.Kind() == reflect.Struct {
+				if found, ok := findTomlField(embedded, name); ok {
+					return found, true
 				}
 			}
-			if match {
-				flaegArgs = append(flaegArgs, "--"+strings.ToLower(key.String()))
+			continue
+		}
+		if fieldName == name || strings.EqualFold(fieldName, name) {
+			return structValue.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// defaultPointer returns a new pointer of type ptrType on a copy of defaultField, or on a zero value
+func defaultPointer(ptrType reflect.Type, defaultField reflect.Value) reflect.Value {
+	ptr := reflect.New(ptrType.Elem())
+	if defaultField.IsValid() && defaultField.Kind() == reflect.Ptr && !defaultField.IsNil() {
+		ptr.Elem().Set(copyDefault(defaultField.Elem()))
+	}
+	return ptr
+}
+
+// copyDefault returns a copy of v, where pointers on struct of exported fields are nil,
+// so that they have to be enabled by their own table.
+// Maps and slices are copied, so that decoding doesn't modify the default values.
+func copyDefault(v reflect.Value) reflect.Value {
+	out := reflect.New(v.Type()).Elem()
+	out.Set(v)
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if len(v.Type().Field(i).PkgPath) > 0 {
+				//if unexported field
+				continue
+			}
+			field := v.Field(i)
+			if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct {
+				out.Field(i).Set(reflect.Zero(field.Type()))
+			} else {
+				out.Field(i).Set(copyDefault(field))
 			}
 		}
+	case reflect.Map:
+		if !v.IsNil() {
+			out.Set(reflect.MakeMap(v.Type()))
+			for _, key := range v.MapKeys() {
+				out.SetMapIndex(key, v.MapIndex(key))
+			}
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			out.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+			reflect.Copy(out, v)
+		}
 	}
-	return flaegArgs, hasUnderField, nil
+	return out
 }
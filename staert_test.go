@@ -3,13 +3,16 @@ package staert
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/containous/flaeg"
 )
 
@@ -1524,6 +1527,11 @@ func TestPreprocessDir(t *testing.T) {
 		"$HOME/dir1/dir2":     os.Getenv("HOME") + "/dir1/dir2",
 		"/etc/test":           "/etc/test",
 		"/etc/dir1/file1.ext": "/etc/dir1/file1.ext",
+		"~":                   os.Getenv("HOME"),
+		"~/dir1":              os.Getenv("HOME") + "/dir1",
+		"${HOME}/dir1":        os.Getenv("HOME") + "/dir1",
+		"/etc/$HOME/dir1":     "/etc" + os.Getenv("HOME") + "/dir1",
+		"/etc/${HOME}dir1":    "/etc" + os.Getenv("HOME") + "dir1",
 	}
 	for in, check := range checkMap {
 		out, err := preprocessDir(in)
@@ -1537,6 +1545,34 @@ func TestPreprocessDir(t *testing.T) {
 
 }
 
+func TestPreprocessDirMissingVariableShouldFail(t *testing.T) {
+	os.Unsetenv("STAERT_TEST_MISSING")
+	_, err := preprocessDir("/etc/${STAERT_TEST_MISSING}/dir1")
+	errExp := "environment variable STAERT_TEST_MISSING not set in /etc/${STAERT_TEST_MISSING}/dir1"
+	if err == nil || err.Error() != errExp {
+		t.Errorf("Expected error %s\n got : %v", errExp, err)
+	}
+}
+
+func TestXDGConfigDirs(t *testing.T) {
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	defer os.Setenv("XDG_CONFIG_DIRS", os.Getenv("XDG_CONFIG_DIRS"))
+
+	os.Setenv("XDG_CONFIG_HOME", "")
+	os.Setenv("XDG_CONFIG_DIRS", "")
+	check := []string{"~/.config/myapp", "/etc/xdg/myapp"}
+	if result := XDGConfigDirs("myapp"); !reflect.DeepEqual(result, check) {
+		t.Errorf("Expected %v\nGot %v", check, result)
+	}
+
+	os.Setenv("XDG_CONFIG_HOME", "/home/user/conf")
+	os.Setenv("XDG_CONFIG_DIRS", "/etc/xdg1:/etc/xdg2")
+	check = []string{"/home/user/conf/myapp", "/etc/xdg1/myapp", "/etc/xdg2/myapp"}
+	if result := XDGConfigDirs("myapp"); !reflect.DeepEqual(result, check) {
+		t.Errorf("Expected %v\nGot %v", check, result)
+	}
+}
+
 func TestFindFile(t *testing.T) {
 	result := findFile("nothing", []string{"", "$HOME/test", "toml"})
 
@@ -1613,6 +1649,43 @@ func TestFindFileSliceFileAndDirFirstIf(t *testing.T) {
 		t.Errorf("Expected %s\nGot %s", check, result)
 	}
 }
+func TestFindFileGlob(t *testing.T) {
+	//check
+	thisPath, _ := filepath.Abs(".")
+	check := thisPath + "/toml/conf.d/10-ptrstruct1.toml"
+	if result := findFile("", []string{"/any/other/path", "./toml/*.d/*.toml"}); result != check {
+		t.Errorf("Expected %s\nGot %s", check, result)
+	}
+}
+func TestTomlSourceRequiredShouldFail(t *testing.T) {
+	os.Unsetenv("STAERT_TEST_MISSING")
+	rootCmd := &flaeg.Command{
+		Name:                  "test",
+		Config:                &StructPtr{},
+		DefaultPointersConfig: &StructPtr{},
+	}
+	toml := NewTomlSource("missing", []string{"", "/any/other/path", "$STAERT_TEST_MISSING/path", "./toml/*.missing"})
+	toml.SetRequired(true)
+	_, err := toml.Parse(rootCmd)
+
+	//check
+	errExp := "TOML config file missing.toml not found, tried: " +
+		"/any/other/path, /any/other/path/missing.toml, " +
+		"$STAERT_TEST_MISSING/path (environment variable STAERT_TEST_MISSING not set in $STAERT_TEST_MISSING/path), " +
+		"./toml/*.missing (no match)"
+	if err == nil || err.Error() != errExp {
+		t.Errorf("Expected error %s\n got : %v", errExp, err)
+	}
+
+	thisPath, _ := filepath.Abs(".")
+	toml = NewTomlDirSource([]string{"./toml/conf.d/10-ptrstruct1.toml"})
+	toml.SetRequired(true)
+	_, err = toml.Parse(rootCmd)
+	errExp = "no TOML config file found, tried: " + thisPath + "/toml/conf.d/10-ptrstruct1.toml"
+	if err == nil || err.Error() != errExp {
+		t.Errorf("Expected error %s\n got : %v", errExp, err)
+	}
+}
 func TestRunWithoutLoadConfig(t *testing.T) {
 	//use buffer instead of stdout
 	var b bytes.Buffer
@@ -1802,3 +1875,541 @@ func TestFlaegTomlSubCommandParseAllSourcesShouldError(t *testing.T) {
 		t.Errorf("Experted error %s\n got : %s", errExp, err)
 	}
 }
+
+func TestTomlSourceInclude(t *testing.T) {
+	//Init
+	config := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    1,
+			S1String: "S1StringInitConfig",
+		},
+		DurationField: flaeg.Duration(time.Second),
+	}
+	defaultPointersConfig := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    11,
+			S1String: "S1StringDefaultPointersConfig",
+			S1Bool:   true,
+			S1PtrStruct3: &Struct3{
+				S3Float64: 11.11,
+			},
+		},
+	}
+
+	//Test
+	rootCmd := &flaeg.Command{
+		Name:                  "test",
+		Description:           "description test",
+		Config:                config,
+		DefaultPointersConfig: defaultPointersConfig,
+		Run: func() error {
+			return nil
+		},
+	}
+	s := NewStaert(rootCmd)
+	toml := NewTomlSource("include", []string{"./toml/", "/any/other/path"})
+	s.AddSource(toml)
+
+	if err := s.parseConfigAllSources(rootCmd); err != nil {
+		t.Errorf("Error %v", err)
+	}
+
+	//Check : include.toml overrides the files it includes
+	check := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    28,
+			S1String: "S1StringConfD",
+			S1Bool:   true,
+		},
+		DurationField: flaeg.Duration(28 * time.Second),
+	}
+	if !reflect.DeepEqual(rootCmd.Config, check) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", check.PtrStruct1, config.PtrStruct1)
+	}
+
+	thisPath, _ := filepath.Abs(".")
+	checkFiles := []string{
+		thisPath + "/toml/include.toml",
+		thisPath + "/toml/conf.d/10-ptrstruct1.toml",
+		thisPath + "/toml/conf.d/20-override.toml",
+	}
+	if !reflect.DeepEqual(toml.ConfigFilesUsed(), checkFiles) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", checkFiles, toml.ConfigFilesUsed())
+	}
+	if toml.ConfigFileUsed() != checkFiles[0] {
+		t.Errorf("\nexpected\t: %s\ngot\t\t\t: %s\n", checkFiles[0], toml.ConfigFileUsed())
+	}
+}
+
+func TestTomlDirSource(t *testing.T) {
+	//Init
+	config := &StructPtr{
+		DurationField: flaeg.Duration(time.Second),
+	}
+	defaultPointersConfig := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    11,
+			S1String: "S1StringDefaultPointersConfig",
+			S1Bool:   true,
+		},
+	}
+
+	//Test
+	rootCmd := &flaeg.Command{
+		Name:                  "test",
+		Description:           "description test",
+		Config:                config,
+		DefaultPointersConfig: defaultPointersConfig,
+		Run: func() error {
+			return nil
+		},
+	}
+	s := NewStaert(rootCmd)
+	toml := NewTomlDirSource([]string{"", "./toml/conf.d", "/any/other/path"})
+	s.AddSource(toml)
+
+	if err := s.parseConfigAllSources(rootCmd); err != nil {
+		t.Errorf("Error %v", err)
+	}
+
+	//Check
+	check := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    42,
+			S1String: "S1StringConfD",
+			S1Bool:   true,
+		},
+		DurationField: flaeg.Duration(42 * time.Second),
+	}
+	if !reflect.DeepEqual(rootCmd.Config, check) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", check.PtrStruct1, config.PtrStruct1)
+	}
+	if len(toml.ConfigFilesUsed()) != 2 {
+		t.Errorf("expected 2 files used, got %+v", toml.ConfigFilesUsed())
+	}
+}
+
+func TestTomlSourceIncludeShouldFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "staert")
+	if err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkMap := map[string]string{
+		"cycle":   "include = [\"cycle.toml\"]",
+		"missing": "include = [\"missing.toml\"]",
+		"badtype": "include = 42",
+	}
+	for name, content := range checkMap {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Error %v", err)
+		}
+		rootCmd := &flaeg.Command{
+			Name:                  "test",
+			Config:                &StructPtr{},
+			DefaultPointersConfig: &StructPtr{},
+		}
+		if _, err := NewTomlSource(name, []string{dir}).Parse(rootCmd); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestTomlSourceProfiles(t *testing.T) {
+	os.Setenv("STAERT_TEST_PROFILE", "prod")
+	defer os.Unsetenv("STAERT_TEST_PROFILE")
+
+	defaultPointersConfig := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    11,
+			S1String: "S1StringDefaultPointersConfig",
+			S1Bool:   true,
+		},
+		PtrStruct2: &Struct2{
+			S2Int64:  22,
+			S2String: "S2StringDefaultPointersConfig",
+		},
+	}
+	checkBase := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    28,
+			S1String: "S1StringDefaultPointersConfig",
+			S1Bool:   true,
+		},
+		DurationField: flaeg.Duration(28 * time.Second),
+	}
+	checkDev := &StructPtr{
+		PtrStruct1:    checkBase.PtrStruct1,
+		DurationField: flaeg.Duration(42 * time.Second),
+	}
+	checkProd := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    28,
+			S1String: "S1StringProd",
+			S1Bool:   true,
+		},
+		PtrStruct2:    defaultPointersConfig.PtrStruct2,
+		DurationField: flaeg.Duration(28 * time.Second),
+	}
+	checkDevProd := &StructPtr{
+		PtrStruct1:    checkProd.PtrStruct1,
+		PtrStruct2:    defaultPointersConfig.PtrStruct2,
+		DurationField: flaeg.Duration(42 * time.Second),
+	}
+
+	testCases := []struct {
+		desc  string
+		setup func(ts *TomlSource)
+		check *StructPtr
+	}{
+		{
+			desc:  "no profile",
+			setup: func(ts *TomlSource) {},
+			check: checkBase,
+		},
+		{
+			desc:  "API",
+			setup: func(ts *TomlSource) { ts.SetProfile("dev") },
+			check: checkDev,
+		},
+		{
+			desc:  "API many profiles",
+			setup: func(ts *TomlSource) { ts.SetProfile("dev, prod") },
+			check: checkDevProd,
+		},
+		{
+			desc:  "env",
+			setup: func(ts *TomlSource) { ts.SetProfileEnv("STAERT_TEST_PROFILE") },
+			check: checkProd,
+		},
+		{
+			desc: "flag overrides env",
+			setup: func(ts *TomlSource) {
+				ts.SetProfileEnv("STAERT_TEST_PROFILE")
+				ts.SetProfileFlag([]string{"--stringfield=foo", "--profile", "dev"}, "profile")
+			},
+			check: checkDev,
+		},
+		{
+			desc: "API overrides flag",
+			setup: func(ts *TomlSource) {
+				ts.SetProfileFlag([]string{"--profile=dev"}, "profile")
+				ts.SetProfile("prod")
+			},
+			check: checkProd,
+		},
+	}
+	for _, test := range testCases {
+		config := &StructPtr{
+			DurationField: flaeg.Duration(time.Second),
+		}
+		rootCmd := &flaeg.Command{
+			Name:                  "test",
+			Description:           "description test",
+			Config:                config,
+			DefaultPointersConfig: defaultPointersConfig,
+		}
+		toml := NewTomlSource("profiles", []string{"./toml/"})
+		test.setup(toml)
+		if _, err := toml.Parse(rootCmd); err != nil {
+			t.Errorf("%s: Error %v", test.desc, err)
+		}
+		if !reflect.DeepEqual(rootCmd.Config, test.check) {
+			t.Errorf("%s:\nexpected\t: %+v %+v\ngot\t\t\t: %+v %+v\n", test.desc, test.check.PtrStruct1, test.check.PtrStruct2, config.PtrStruct1, config.PtrStruct2)
+		}
+	}
+}
+
+func TestTomlSourceUnknownProfileShouldFail(t *testing.T) {
+	rootCmd := &flaeg.Command{
+		Name:                  "test",
+		Config:                &StructPtr{},
+		DefaultPointersConfig: &StructPtr{},
+	}
+	toml := NewTomlSource("profiles", []string{"./toml/"})
+	toml.SetProfile("staging")
+	_, err := toml.Parse(rootCmd)
+	errExp := "profile staging not found"
+	if err == nil || err.Error() != errExp {
+		t.Errorf("Expected error %s\n got : %v", errExp, err)
+	}
+}
+
+func TestTomlReaderAndBytesSources(t *testing.T) {
+	content := "DurationField= 28\n[PtrStruct1]\nS1Int= 28\n"
+	defaultPointersConfig := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    11,
+			S1String: "S1StringDefaultPointersConfig",
+			S1Bool:   true,
+		},
+	}
+	check := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    28,
+			S1String: "S1StringDefaultPointersConfig",
+			S1Bool:   true,
+		},
+		DurationField: flaeg.Duration(28 * time.Second),
+	}
+
+	sources := map[string]*TomlSource{
+		"reader": NewTomlReaderSource(strings.NewReader(content)),
+		"bytes":  NewTomlBytesSource([]byte(content)),
+	}
+	for name, toml := range sources {
+		// parse twice, the reader must be read only once
+		for i := 0; i < 2; i++ {
+			config := &StructPtr{}
+			rootCmd := &flaeg.Command{
+				Name:                  "test",
+				Config:                config,
+				DefaultPointersConfig: defaultPointersConfig,
+			}
+			if _, err := toml.Parse(rootCmd); err != nil {
+				t.Errorf("%s: Error %v", name, err)
+			}
+			if !reflect.DeepEqual(rootCmd.Config, check) {
+				t.Errorf("%s:\nexpected\t: %+v\ngot\t\t\t: %+v\n", name, check.PtrStruct1, config.PtrStruct1)
+			}
+		}
+		if len(toml.ConfigFilesUsed()) != 0 {
+			t.Errorf("%s: expected no file used, got %v", name, toml.ConfigFilesUsed())
+		}
+	}
+}
+
+func TestTomlSourceStdin(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	stdin := os.Stdin
+	os.Stdin = reader
+	defer func() { os.Stdin = stdin }()
+	go func() {
+		fmt.Fprint(writer, "DurationField= 42\ninclude= [\"toml/conf.d/10-ptrstruct1.toml\"]\n")
+		writer.Close()
+	}()
+
+	config := &StructPtr{}
+	rootCmd := &flaeg.Command{
+		Name:                  "test",
+		Config:                config,
+		DefaultPointersConfig: &StructPtr{PtrStruct1: &Struct1{S1Int: 11}},
+	}
+	toml := NewTomlSource("trivial", []string{"-", "./toml/"})
+	if _, err := toml.Parse(rootCmd); err != nil {
+		t.Errorf("Error %v", err)
+	}
+
+	//check
+	check := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    11,
+			S1String: "S1StringConfD",
+		},
+		DurationField: flaeg.Duration(42 * time.Second),
+	}
+	if !reflect.DeepEqual(rootCmd.Config, check) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", check, config)
+	}
+	if toml.ConfigFileUsed() != "-" {
+		t.Errorf("Expected config file used -, got %s", toml.ConfigFileUsed())
+	}
+}
+
+func TestTomlFSSource(t *testing.T) {
+	fsys := fstest.MapFS{
+		"conf/app.toml":         {Data: []byte("include= [\"conf.d/*.toml\"]\n[PtrStruct1]\nS1Int= 28\n")},
+		"conf/conf.d/10-a.toml": {Data: []byte("[PtrStruct1]\nS1String= \"S1StringFS\"\n")},
+		"conf/conf.d/20-b.toml": {Data: []byte("DurationField= 42\n")},
+	}
+
+	config := &StructPtr{}
+	rootCmd := &flaeg.Command{
+		Name:                  "test",
+		Config:                config,
+		DefaultPointersConfig: &StructPtr{PtrStruct1: &Struct1{S1Int: 11, S1Bool: true}},
+	}
+	toml := NewTomlFSSource(fsys, "app", []string{"/any/other/path", "/con*"})
+	if _, err := toml.Parse(rootCmd); err != nil {
+		t.Errorf("Error %v", err)
+	}
+
+	//check
+	check := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    28,
+			S1String: "S1StringFS",
+			S1Bool:   true,
+		},
+		DurationField: flaeg.Duration(42 * time.Second),
+	}
+	if !reflect.DeepEqual(rootCmd.Config, check) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", check.PtrStruct1, config.PtrStruct1)
+	}
+	checkFiles := []string{"conf/app.toml", "conf/conf.d/10-a.toml", "conf/conf.d/20-b.toml"}
+	if !reflect.DeepEqual(toml.ConfigFilesUsed(), checkFiles) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", checkFiles, toml.ConfigFilesUsed())
+	}
+}
+func TestTomlSourceIncludeOverride(t *testing.T) {
+	fsys := fstest.MapFS{
+		"conf/app.toml":    {Data: []byte("include= [\"common.toml\", \"region.toml\"]\nDurationField= 42\n[PtrStruct1]\nS1Int= 42\n")},
+		"conf/common.toml": {Data: []byte("DurationField= 1\n[PtrStruct1]\nS1Int= 1\nS1String= \"common\"\nS1Bool= true\n")},
+		"conf/region.toml": {Data: []byte("[PtrStruct1]\nS1String= \"region\"\n")},
+	}
+	config := &StructPtr{}
+	rootCmd := &flaeg.Command{
+		Name:                  "test",
+		Config:                config,
+		DefaultPointersConfig: &StructPtr{PtrStruct1: &Struct1{}},
+	}
+	toml := NewTomlFSSource(fsys, "app", []string{"/conf"})
+	if _, err := toml.Parse(rootCmd); err != nil {
+		t.Errorf("Error %v", err)
+	}
+
+	//check : the including file overrides the included ones, later includes override earlier ones
+	check := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int:    42,
+			S1String: "region",
+			S1Bool:   true,
+		},
+		DurationField: flaeg.Duration(42 * time.Second),
+	}
+	if !reflect.DeepEqual(rootCmd.Config, check) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", check, config)
+	}
+	if toml.ConfigFileUsed() != "conf/app.toml" {
+		t.Errorf("Expected config file used conf/app.toml, got %s", toml.ConfigFileUsed())
+	}
+}
+
+func TestEnablePointers(t *testing.T) {
+	config := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int: 1,
+		},
+	}
+	defaultPointersConfig := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int: 11,
+			S1PtrStruct3: &Struct3{
+				S3Float64: 11.11,
+			},
+		},
+	}
+	// children before parents, like with an include
+	keys := []tomlKey{
+		{Key: toml.Key{"ptrstruct1", "s1ptrstruct3"}, Type: "Hash"},
+		{Key: toml.Key{"PtrStruct2"}, Type: "Hash"},
+		{Key: toml.Key{"PtrStruct1"}, Type: "Hash"},
+		{Key: toml.Key{"DurationField"}, Type: "Integer"},
+		{Key: toml.Key{"Unknown", "Field"}, Type: "Hash"},
+	}
+	enablePointers(config, defaultPointersConfig, keys)
+
+	//check
+	check := &StructPtr{
+		PtrStruct1: &Struct1{
+			S1Int: 11,
+			S1PtrStruct3: &Struct3{
+				S3Float64: 11.11,
+			},
+		},
+		PtrStruct2: &Struct2{},
+	}
+	if !reflect.DeepEqual(config, check) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", check, config)
+	}
+	if config.PtrStruct1 == defaultPointersConfig.PtrStruct1 || config.PtrStruct1.S1PtrStruct3 == defaultPointersConfig.PtrStruct1.S1PtrStruct3 {
+		t.Errorf("pointers must not share the default values")
+	}
+}
+
+func TestCopyDefault(t *testing.T) {
+	type withMap struct {
+		Entries map[string]BenchEntry
+		Ptr     *Struct3
+		Sub     Struct1
+	}
+	defaultValue := withMap{
+		Entries: map[string]BenchEntry{"a": {Name: "a"}},
+		Ptr:     &Struct3{S3Float64: 1.1},
+		Sub:     Struct1{S1Int: 1, S1PtrStruct3: &Struct3{S3Float64: 1.1}},
+	}
+	copied := copyDefault(reflect.ValueOf(defaultValue)).Interface().(withMap)
+	copied.Entries["b"] = BenchEntry{Name: "b"}
+
+	//check
+	check := withMap{
+		Entries: map[string]BenchEntry{"a": {Name: "a"}, "b": {Name: "b"}},
+		Sub:     Struct1{S1Int: 1},
+	}
+	if !reflect.DeepEqual(copied, check) {
+		t.Errorf("\nexpected\t: %+v\ngot\t\t\t: %+v\n", check, copied)
+	}
+	if len(defaultValue.Entries) != 1 {
+		t.Errorf("default value modified: %+v", defaultValue.Entries)
+	}
+}
+
+//BenchStruct : Struct with a map of tables
+type BenchStruct struct {
+	PtrStruct1 *Struct1              `description:"Enable Struct1"`
+	Entries    map[string]BenchEntry `description:"Entries"`
+}
+
+//BenchEntry : trivial Struct
+type BenchEntry struct {
+	Name   string  `description:"Name"`
+	Weight int     `description:"Weight"`
+	Ratio  float64 `description:"Ratio"`
+}
+
+// generateBenchToml generates a TOML document with a pointer table and nbEntries tables of 3 keys
+func generateBenchToml(nbEntries int) []byte {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintln(buffer, "[PtrStruct1]\nS1Int= 28\n[PtrStruct1.S1PtrStruct3]\nS3Float64= 28.28")
+	for i := 0; i < nbEntries; i++ {
+		fmt.Fprintf(buffer, "[Entries.entry%d]\nName= \"entry%d\"\nWeight= %d\nRatio= %d.5\n", i, i, i, i)
+	}
+	return buffer.Bytes()
+}
+
+func benchmarkTomlSourceParse(b *testing.B, nbEntries int) {
+	data := generateBenchToml(nbEntries)
+	defaultPointersConfig := &BenchStruct{
+		PtrStruct1: &Struct1{
+			S1Int:        11,
+			S1PtrStruct3: &Struct3{S3Float64: 11.11},
+		},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rootCmd := &flaeg.Command{
+			Name:                  "bench",
+			Config:                &BenchStruct{},
+			DefaultPointersConfig: defaultPointersConfig,
+		}
+		if _, err := NewTomlBytesSource(data).Parse(rootCmd); err != nil {
+			b.Fatalf("Error %v", err)
+		}
+	}
+}
+
+func BenchmarkTomlSourceParse100(b *testing.B) {
+	benchmarkTomlSourceParse(b, 100)
+}
+
+func BenchmarkTomlSourceParse1000(b *testing.B) {
+	benchmarkTomlSourceParse(b, 1000)
+}
+
+func BenchmarkTomlSourceParse5000(b *testing.B) {
+	benchmarkTomlSourceParse(b, 5000)
+}
@@ -0,0 +1,108 @@
+package staert
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// stdinName is the fullpath to give to read the TOML file from stdin
+const stdinName = "-"
+
+// tomlFS is the file system TomlSource reads files from
+type tomlFS interface {
+	readFile(name string) ([]byte, error)
+	// expand returns the paths matching pathIn, in lexical order
+	expand(pathIn string) ([]string, error)
+	isFile(name string) bool
+	isAbs(name string) bool
+	join(elem ...string) string
+	dir(name string) string
+}
+
+// osFS reads files from the OS file system
+// Paths are expanded by preprocessDir, "-" is stdin
+type osFS struct{}
+
+func (osFS) readFile(name string) ([]byte, error) {
+	if name == stdinName {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func (osFS) expand(pathIn string) ([]string, error) {
+	if pathIn == stdinName {
+		return []string{stdinName}, nil
+	}
+	return expandPath(pathIn)
+}
+
+func (osFS) isFile(name string) bool {
+	return name == stdinName || isFile(name)
+}
+
+func (osFS) isAbs(name string) bool {
+	return filepath.IsAbs(name)
+}
+
+func (osFS) join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (osFS) dir(name string) string {
+	return filepath.Dir(name)
+}
+
+// ioFS reads files from a fs.FS (like embed.FS)
+// Paths are slash-separated and relative to the root of the fs.FS
+type ioFS struct {
+	fsys fs.FS
+}
+
+func (f ioFS) readFile(name string) ([]byte, error) {
+	return fs.ReadFile(f.fsys, name)
+}
+
+func (f ioFS) expand(pathIn string) ([]string, error) {
+	name := path.Clean(strings.TrimPrefix(pathIn, "/"))
+	if !hasGlobMeta(name) {
+		return []string{name}, nil
+	}
+	return fs.Glob(f.fsys, name)
+}
+
+func (f ioFS) isFile(name string) bool {
+	fileInfo, err := fs.Stat(f.fsys, name)
+	return err == nil && !fileInfo.IsDir()
+}
+
+func (f ioFS) isAbs(name string) bool {
+	return path.IsAbs(name)
+}
+
+func (f ioFS) join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (f ioFS) dir(name string) string {
+	return path.Dir(name)
+}
+
+// globFiles returns the regular files matching pattern, in lexical order
+func globFiles(fsys tomlFS, pattern string) ([]string, error) {
+	matches, err := fsys.expand(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, match := range matches {
+		if fsys.isFile(match) {
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}